@@ -21,15 +21,18 @@ import (
 	"github.com/openziti/cobra-to-md"
 	"github.com/openziti/ziti/ziti/enroll"
 
-	"io/fs"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"zssh/zsshlib"
 
 	"github.com/pkg/sftp"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
 
 	"github.com/openziti/ziti/ziti/cmd/common"
 )
@@ -41,24 +44,40 @@ var (
 	date    = "unknown"
 )
 
+// checksums holds the SHA-256 of the files verified with --verify by transfer name, until they are reported
+var checksums sync.Map
+
 var rootCmd = &cobra.Command{
 	Use: "zscp <remoteUsername>@<targetIdentity>:[Remote Path] [Local Path] or " +
-		"zscp [Local Path] <remoteUsername>@<targetIdentity>:[Remote Path]",
+		"zscp [Local Path] <remoteUsername>@<targetIdentity>:[Remote Path] or " +
+		"zscp <remoteUsername>@<targetIdentity>:[Remote Path] <remoteUsername>@<targetIdentity>:[Remote Path]",
 	Short:   "Z(iti)scp, Carb-loaded ssh performs faster and stronger than ssh",
-	Long:    "Z(iti)scp is a version of ssh that utilizes a ziti network to provide a faster and more secure remote connection. A ziti connection must be established before use",
+	Long:    "Z(iti)scp is a version of ssh that utilizes a ziti network to provide a faster and more secure remote connection. A ziti connection must be established before use\n\n" + zsshlib.FilterHelp,
 	Version: fmt.Sprintf("%s (built:%s, hash:%s)", version, date, commit),
 	Args:    cobra.MinimumNArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
 		var remoteFilePath string
 		var localFilePaths []string
 		var isCopyToRemote bool
+		// failed transfers are reported last, once the summary is printed and the directories are finished
+		var transferErr error
+		defer func() {
+			if transferErr != nil {
+				logrus.Fatal(transferErr)
+			}
+		}()
 
 		logrus.StandardLogger().Level = logrus.FatalLevel
 		if flags.Debug {
 			zsshlib.Logger().SetLevel(logrus.DebugLevel)
 		}
 
-		if strings.ContainsAny(args[0], ":") {
+		if len(args) == 2 && zsshlib.IsRemotePath(args[0]) && zsshlib.IsRemotePath(args[1]) {
+			transferErr = copyBetweenRemotes(cmd, args[0], args[1])
+			return
+		}
+
+		if zsshlib.IsRemotePath(args[0]) {
 			remoteFilePath = args[0]
 			localFilePaths = args[1:]
 			if len(localFilePaths) > 1 {
@@ -66,7 +85,7 @@ var rootCmd = &cobra.Command{
 			}
 			isCopyToRemote = false
 
-		} else if strings.ContainsAny(args[len(args)-1], ":") {
+		} else if zsshlib.IsRemotePath(args[len(args)-1]) {
 			remoteFilePath = args[len(args)-1]
 			localFilePaths = args[0 : len(args)-1]
 			isCopyToRemote = true
@@ -86,63 +105,83 @@ var rootCmd = &cobra.Command{
 
 		targetIdentity := zsshlib.ParseTargetIdentity(remoteFilePath)
 		cfg := zsshlib.FindConfigByKey(targetIdentity)
-		zsshlib.Combine(cmd, &flags.SshFlags, cfg)
+		zsshlib.CombineScp(cmd, &flags, cfg)
 
-		remoteFilePath = zsshlib.ParseFilePath(remoteFilePath)
+		remoteTarget := remoteFilePath
 
-		sshConn := zsshlib.EstablishClient(&flags.SshFlags, remoteFilePath, targetIdentity)
+		sshConn := zsshlib.ConnectClient(&flags.SshFlags, remoteTarget, targetIdentity)
 		defer func() { _ = sshConn.Close() }()
 
-		client, err := sftp.NewClient(sshConn)
+		client, err := zsshlib.NewSftpClient(sshConn, flags.ChunkSize, flags.MaxRequests)
 		if err != nil {
 			logrus.Fatalf("error creating sftp client: %v", err)
 		}
 		defer func() { _ = client.Close() }()
 
-		if remoteFilePath == "~" {
-			remoteFilePath = ""
-		} else if len(remoteFilePath) > 1 && remoteFilePath[0:1] == "~" {
-			remoteFilePath = remoteFilePath[2:]
+		hasher := zsshlib.NewRemoteHasher(sshConn, client)
+		defer func() { _ = hasher.Close() }()
+		if remoteFilePath, err = resolveRemotePath(client, remoteTarget); err != nil {
+			logrus.Fatal(err)
 		}
-
-		remoteFilePath, err = client.RealPath(remoteFilePath)
+		remoteGlob, err := expandRemoteGlob(client, remoteFilePath)
 		if err != nil {
-			logrus.Fatalf("cannot find remote file path: %s [%v]", remoteFilePath, err)
+			logrus.Fatal(err)
 		}
 
-		remoteGlob, err := client.Glob(remoteFilePath)
+		progress := newProgressBar()
+		defer progress.PrintSummary()
+		transferOpts := zsshlib.TransferOptions{Progress: progress.Update, Resume: flags.Resume, Preserve: flags.Preserve, SrcHasher: hasher, DstHasher: hasher}
+		var dirAttributes zsshlib.DirectoryAttributes
+		defer dirAttributes.Apply()
+
+		links, err := zsshlib.ParseLinkPolicy(flags.Links)
 		if err != nil {
-			logrus.Fatalf("file pattern [%s] not recognized [%v]", remoteFilePath, err)
-		} else if remoteGlob == nil {
-			remoteGlob = append(remoteGlob, remoteFilePath)
+			transferErr = err
+			return
 		}
+		filter := &zsshlib.PathFilter{Excludes: flags.Excludes, Includes: flags.Includes}
 
+		// files are collected while walking, directories are created as they are found so they exist before
+		// the transfers into them run
+		var transfers []zsshlib.Transfer
 		if isCopyToRemote { //local to remote
 			for i, localFilePath := range localFilePaths {
 				if flags.Recursive {
 					baseDir := filepath.Base(localFilePath)
-					err := filepath.WalkDir(localFilePath, func(path string, info fs.DirEntry, err error) error {
-						remotePath := filepath.Join(remoteFilePath, baseDir, after(path, baseDir))
-						remotePath = strings.ReplaceAll(remotePath, `\`, `/`)
-						if info.IsDir() {
+					rootFilter, err := filter.WithIgnoreFile(openLocal, filepath.Join(localFilePath, zsshlib.IgnoreFileName))
+					if err != nil {
+						transferErr = err
+						return
+					}
+					err = zsshlib.WalkLocalTree(localFilePath, rootFilter, links, func(e zsshlib.TreeEntry) error {
+						remotePath := path.Join(remoteFilePath, baseDir, e.Rel)
+						switch {
+						case e.LinkTarget != "":
+							transfers = append(transfers, zsshlib.Transfer{Name: e.Path, Run: func() error {
+								return zsshlib.CreateRemoteLink(client, filepath.ToSlash(e.LinkTarget), remotePath)
+							}})
+						case e.Info.IsDir():
 							err = client.Mkdir(remotePath)
 							if err != nil {
 								zsshlib.Logger().Debugf("%s", err) //occurs when directories exist already. Is not fatal. Only logs when debug flag is set.
 							} else {
 								zsshlib.Logger().Debugf("made directory: %s", remotePath)
 							}
-						} else {
-							err = zsshlib.SendFile(client, path, remotePath)
-							if err != nil {
-								return fmt.Errorf("could not send file: %s [%v]", path, err)
-							} else {
-								logrus.Infof("sent file: %s ==> %s", path, remotePath)
+							if flags.Preserve {
+								dirAttributes.Add(func() error {
+									return zsshlib.SetRemoteAttributes(client, remotePath, e.Info)
+								})
 							}
+						default:
+							transfers = append(transfers, verifiedTransfer(e.Path, func() error {
+								return zsshlib.SendFile(client, e.Path, remotePath, transferOpts)
+							}, zsshlib.LocalChecksum, hasher.Checksum, remotePath))
 						}
 						return nil
 					})
 					if err != nil {
-						logrus.Fatal(err)
+						transferErr = err
+						return
 					}
 				} else {
 					if i > 0 {
@@ -150,66 +189,262 @@ var rootCmd = &cobra.Command{
 					}
 					remoteFilePath = zsshlib.AppendBaseName(client, remoteFilePath, localFilePath, flags.Debug)
 					remoteFilePath = strings.ReplaceAll(remoteFilePath, `\`, `/`)
-					err = zsshlib.SendFile(client, localFilePath, remoteFilePath)
-					if err != nil {
-						logrus.Errorf("could not send file: %s [%v]", localFilePath, err)
-					} else {
-						logrus.Infof("sent file: %s ==> %s", localFilePath, remoteFilePath)
-					}
+					remotePath := remoteFilePath
+					transfers = append(transfers, verifiedTransfer(localFilePath, func() error {
+						return zsshlib.SendFile(client, localFilePath, remotePath, transferOpts)
+					}, zsshlib.LocalChecksum, hasher.Checksum, remotePath))
 				}
 			}
 		} else { //remote to local
-			localFilePath := localFilePaths[0]
-			for _, remoteFilePath = range remoteGlob {
+			for _, remoteFilePath := range remoteGlob {
 				if flags.Recursive {
-					baseDir := filepath.Base(remoteFilePath)
-					walker := client.Walk(remoteFilePath)
-					for walker.Step() {
-						localPath := filepath.Join(localFilePath, baseDir, after(walker.Path(), baseDir)) //saves base directory to cut remote directory after it to append to localpath
-						if walker.Stat().IsDir() {
-							err = os.Mkdir(localPath, os.ModePerm)
+					baseDir := path.Base(remoteFilePath)
+					rootFilter, err := filter.WithIgnoreFile(openRemote(client), path.Join(remoteFilePath, zsshlib.IgnoreFileName))
+					if err != nil {
+						transferErr = err
+						return
+					}
+					err = zsshlib.WalkRemoteTree(client, remoteFilePath, rootFilter, links, func(e zsshlib.TreeEntry) error {
+						localPath := filepath.Join(localFilePaths[0], baseDir, filepath.FromSlash(e.Rel))
+						switch {
+						case e.LinkTarget != "":
+							transfers = append(transfers, zsshlib.Transfer{Name: e.Path, Run: func() error {
+								return zsshlib.CreateLocalLink(e.LinkTarget, localPath)
+							}})
+						case e.Info.IsDir():
+							err = os.Mkdir(localPath, e.Info.Mode().Perm())
 							if err != nil {
 								zsshlib.Logger().Debugf("failed to make directory: %s [%v]", localPath, err) //occurs when directories exist already. Is not fatal. Only logs when debug flag is set.
 							} else {
 								zsshlib.Logger().Debugf("made directory: %s", localPath)
 							}
-						} else {
-							err = zsshlib.RetrieveRemoteFiles(client, localPath, walker.Path())
-							if err != nil {
-								logrus.Fatalf("failed to retrieve file: %s [%v]", walker.Path(), err)
+							if flags.Preserve {
+								dirAttributes.Add(func() error {
+									return zsshlib.SetLocalAttributes(localPath, e.Info)
+								})
 							}
+						default:
+							transfers = append(transfers, verifiedTransfer(e.Path, func() error {
+								return zsshlib.RetrieveRemoteFiles(client, localPath, e.Path, transferOpts)
+							}, hasher.Checksum, zsshlib.LocalChecksum, localPath))
 						}
+						return nil
+					})
+					if err != nil {
+						transferErr = err
+						return
 					}
 				} else {
+					localFilePath := localFilePaths[0]
 					if info, _ := os.Lstat(localFilePaths[0]); info.IsDir() {
 						localFilePath = filepath.Join(localFilePaths[0], filepath.Base(remoteFilePath))
 					}
-					err = zsshlib.RetrieveRemoteFiles(client, localFilePath, remoteFilePath)
-					if err != nil {
-						logrus.Fatalf("failed to retrieve file: %s [%v]", remoteFilePath, err)
-					}
+					transfers = append(transfers, verifiedTransfer(remoteFilePath, func() error {
+						return zsshlib.RetrieveRemoteFiles(client, localFilePath, remoteFilePath, transferOpts)
+					}, hasher.Checksum, zsshlib.LocalChecksum, localFilePath))
 				}
 			}
 		}
+
+		transferErr = zsshlib.RunTransfers(flags.Parallel, transfers, zsshlib.LogTransfers("transferred", &checksums))
 	},
 }
 
 func init() {
 	flags.OIDCFlags(rootCmd)
+	flags.ControlFlags(rootCmd)
+	flags.TransferFlags(rootCmd)
 	rootCmd.Flags().BoolVarP(&flags.Recursive, "recursive", "r", false, "pass to enable recursive file transfer")
+	rootCmd.Flags().BoolVarP(&flags.Quiet, "quiet", "q", false, "do not show progress bars or the transfer summary")
+	rootCmd.Flags().BoolVar(&flags.Resume, "resume", false, "continue partially transferred files instead of starting over")
+	rootCmd.Flags().BoolVar(&flags.Preserve, "preserve", false, "preserve modes and access and modification times of the copied files")
+	rootCmd.Flags().BoolVar(&flags.Verify, "verify", false, "compare the SHA-256 of every copied file with its source, hashed on the remote with the check-file sftp extension or sha256sum. fails on mismatches")
+	rootCmd.Flags().BoolP("relay", "3", false, "copy between two remotes through this host. zscp always relays, the remotes never connect to each other. accepted for scp compatibility")
+	rootCmd.Flags().StringArrayVar(&flags.Excludes, "exclude", nil, "with -r, skip files matching the pattern. can be given multiple times")
+	rootCmd.Flags().StringArrayVar(&flags.Includes, "include", nil, "with -r, do not skip files matching the pattern even if excluded. can be given multiple times")
+	rootCmd.Flags().StringVar(&flags.Links, "links", string(zsshlib.LinksCopy), fmt.Sprintf("with -r, what to do with symbolic links, one of %v. preserve recreates them", zsshlib.LinkPolicies))
+	rootCmd.Flags().IntVarP(&flags.Parallel, "parallel", "j", 0, "number of files to transfer concurrently. default: 1")
 }
 
-func after(value string, a string) string {
-	// Get substring after a string.
-	pos := strings.LastIndex(value, a)
-	if pos == -1 {
-		return ""
+// copyBetweenRemotes copies src on one remote to dst on another. The data is relayed through this process
+// like scp -3, the remotes never connect to each other and nothing is written to local disk.
+func copyBetweenRemotes(cmd *cobra.Command, src string, dst string) error {
+	srcIdentity, dstIdentity := zsshlib.ParseTargetIdentity(src), zsshlib.ParseTargetIdentity(dst)
+	// each remote may have its own config
+	dstFlags := flags
+	zsshlib.CombineScp(cmd, &flags, zsshlib.FindConfigByKey(srcIdentity))
+	zsshlib.CombineScp(cmd, &dstFlags, zsshlib.FindConfigByKey(dstIdentity))
+
+	// with -M each remote gets its own control master
+	srcConn := zsshlib.ConnectClient(&flags.SshFlags, src, srcIdentity)
+	defer func() { _ = srcConn.Close() }()
+	dstConn := zsshlib.ConnectClient(&dstFlags.SshFlags, dst, dstIdentity)
+	defer func() { _ = dstConn.Close() }()
+	srcClient, err := zsshlib.NewSftpClient(srcConn, flags.ChunkSize, flags.MaxRequests)
+	if err != nil {
+		return fmt.Errorf("error creating sftp client for %s: %w", srcIdentity, err)
+	}
+	defer func() { _ = srcClient.Close() }()
+	dstClient, err := zsshlib.NewSftpClient(dstConn, dstFlags.ChunkSize, dstFlags.MaxRequests)
+	if err != nil {
+		return fmt.Errorf("error creating sftp client for %s: %w", dstIdentity, err)
+	}
+	defer func() { _ = dstClient.Close() }()
+	srcHasher := zsshlib.NewRemoteHasher(srcConn, srcClient)
+	defer func() { _ = srcHasher.Close() }()
+	dstHasher := zsshlib.NewRemoteHasher(dstConn, dstClient)
+	defer func() { _ = dstHasher.Close() }()
+
+	srcPath, err := resolveRemotePath(srcClient, src)
+	if err != nil {
+		return err
+	}
+	sources, err := expandRemoteGlob(srcClient, srcPath)
+	if err != nil {
+		return err
+	}
+	dstPath, err := resolveRemotePath(dstClient, dst)
+	if err != nil {
+		return err
 	}
-	adjustedPos := pos + len(a)
-	if adjustedPos >= len(value) {
-		return ""
+	dstInfo, dstErr := dstClient.Stat(dstPath)
+	dstIsDir := dstErr == nil && dstInfo.IsDir()
+	if len(sources) > 1 && !dstIsDir {
+		return fmt.Errorf("destination of multiple files must be a directory: %s", dstPath)
 	}
-	return value[adjustedPos:]
+
+	links, err := zsshlib.ParseLinkPolicy(flags.Links)
+	if err != nil {
+		return err
+	}
+	filter := &zsshlib.PathFilter{Excludes: flags.Excludes, Includes: flags.Includes}
+
+	progress := newProgressBar()
+	defer progress.PrintSummary()
+	transferOpts := zsshlib.TransferOptions{Progress: progress.Update, Resume: flags.Resume, Preserve: flags.Preserve, SrcHasher: srcHasher, DstHasher: dstHasher}
+	var dirAttributes zsshlib.DirectoryAttributes
+	defer dirAttributes.Apply()
+
+	var transfers []zsshlib.Transfer
+	for _, source := range sources {
+		target := dstPath
+		if dstIsDir {
+			target = path.Join(dstPath, path.Base(source))
+		}
+		info, err := srcClient.Stat(source)
+		if err != nil {
+			return fmt.Errorf("cannot read remote file: %s [%w]", source, err)
+		}
+		if !info.IsDir() {
+			transfers = append(transfers, verifiedTransfer(source, func() error {
+				return zsshlib.CopyRemoteFile(srcClient, source, dstClient, target, transferOpts)
+			}, srcHasher.Checksum, dstHasher.Checksum, target))
+			continue
+		}
+		if !flags.Recursive {
+			return fmt.Errorf("%s is a directory, use -r to copy it", source)
+		}
+		rootFilter, err := filter.WithIgnoreFile(openRemote(srcClient), path.Join(source, zsshlib.IgnoreFileName))
+		if err != nil {
+			return err
+		}
+		err = zsshlib.WalkRemoteTree(srcClient, source, rootFilter, links, func(e zsshlib.TreeEntry) error {
+			dstPath := path.Join(target, e.Rel)
+			switch {
+			case e.LinkTarget != "":
+				transfers = append(transfers, zsshlib.Transfer{Name: e.Path, Run: func() error {
+					return zsshlib.CreateRemoteLink(dstClient, e.LinkTarget, dstPath)
+				}})
+			case e.Info.IsDir():
+				if err := dstClient.Mkdir(dstPath); err != nil {
+					zsshlib.Logger().Debugf("%s", err) //occurs when directories exist already
+				} else {
+					zsshlib.Logger().Debugf("made directory: %s", dstPath)
+				}
+				if flags.Preserve {
+					dirAttributes.Add(func() error {
+						return zsshlib.SetRemoteAttributes(dstClient, dstPath, e.Info)
+					})
+				}
+			default:
+				transfers = append(transfers, verifiedTransfer(e.Path, func() error {
+					return zsshlib.CopyRemoteFile(srcClient, e.Path, dstClient, dstPath, transferOpts)
+				}, srcHasher.Checksum, dstHasher.Checksum, dstPath))
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("cannot read remote directory: %s [%w]", source, err)
+		}
+	}
+
+	return zsshlib.RunTransfers(flags.Parallel, transfers, zsshlib.LogTransfers("copied", &checksums))
+}
+
+// verifiedTransfer returns the transfer of the file name by run. With --verify the destination dstPath is then
+// compared with the source, src and dst hashing the files on either side.
+func verifiedTransfer(name string, run func() error, src zsshlib.ChecksumFunc, dst zsshlib.ChecksumFunc, dstPath string) zsshlib.Transfer {
+	return zsshlib.Transfer{Name: name, Run: func() error {
+		if err := run(); err != nil || !flags.Verify {
+			return err
+		}
+		sum, err := zsshlib.VerifyTransfer(src, name, dst, dstPath)
+		if err != nil {
+			return err
+		}
+		checksums.Store(name, sum)
+		return nil
+	}}
+}
+
+// resolveRemotePath returns the absolute remote path of target, <remoteUsername>@<targetIdentity>:[Remote Path].
+// An empty path or ~ is the login directory.
+func resolveRemotePath(client *sftp.Client, target string) (string, error) {
+	remotePath := zsshlib.ParseFilePath(target)
+	if remotePath == "~" {
+		remotePath = ""
+	} else if len(remotePath) > 1 && remotePath[0:1] == "~" {
+		remotePath = remotePath[2:]
+	}
+
+	resolved, err := client.RealPath(remotePath)
+	if err != nil {
+		return "", fmt.Errorf("cannot find remote file path: %s [%w]", remotePath, err)
+	}
+	return resolved, nil
+}
+
+// expandRemoteGlob returns the remote files matching pattern, or pattern itself when nothing matches
+func expandRemoteGlob(client *sftp.Client, pattern string) ([]string, error) {
+	matches, err := client.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("file pattern [%s] not recognized [%w]", pattern, err)
+	} else if matches == nil {
+		matches = append(matches, pattern)
+	}
+	return matches, nil
+}
+
+func openLocal(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func openRemote(client *sftp.Client) func(name string) (io.ReadCloser, error) {
+	return func(name string) (io.ReadCloser, error) {
+		f, err := client.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+}
+
+// newProgressBar returns the progress bar for the transfers. progress bars are only drawn for a person watching
+// a terminal
+func newProgressBar() *zsshlib.ProgressBar {
+	stdoutFd := int(os.Stdout.Fd())
+	width, _, _ := terminal.GetSize(stdoutFd)
+	return zsshlib.NewProgressBar(os.Stdout, !flags.Quiet && terminal.IsTerminal(stdoutFd), width)
 }
 
 func main() {
@@ -217,6 +452,7 @@ func main() {
 	flags.AddCommonFlags(rootCmd)
 	rootCmd.AddCommand(enroll.NewEnrollIdentityCommand(p))
 	rootCmd.AddCommand(zsshlib.NewMfaCmd(&flags.SshFlags))
+	rootCmd.AddCommand(zsshlib.NewSyncCmd(&flags))
 	rootCmd.AddCommand(gendoc.NewGendocCmd(rootCmd))
 	e := rootCmd.Execute()
 	if e != nil {
@@ -0,0 +1,129 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"zssh/zsshlib"
+
+	"github.com/openziti/cobra-to-md"
+	"github.com/openziti/ziti/ziti/cmd/common"
+	"github.com/openziti/ziti/ziti/enroll"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var (
+	flags     = zsshlib.ScpFlags{}
+	batchFile string
+	version   = "v0.0.0"
+	commit    = "unknown"
+	date      = "unknown"
+)
+
+var rootCmd = &cobra.Command{
+	Use:   "zsftp <remoteUsername>@<targetIdentity>[:Remote Path]",
+	Short: "Z(iti)sftp, an interactive file transfer client over ziti",
+	Long: "Z(iti)sftp browses and transfers files over a ziti network like sftp. Commands are read from the terminal, " +
+		"with tab completion of remote paths, or from a batch file with -b. Type help in a session for the commands.",
+	Example: "  zsftp admin@router1:/etc\n  zsftp -b deploy.txt admin@router1",
+	Version: fmt.Sprintf("%s (built:%s, hash:%s)", version, date, commit),
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		logrus.StandardLogger().Level = logrus.FatalLevel
+		if flags.Debug {
+			zsshlib.Logger().SetLevel(logrus.DebugLevel)
+		}
+
+		target := args[0]
+		targetIdentity := zsshlib.ParseTargetIdentity(target)
+		cfg := zsshlib.FindConfigByKey(targetIdentity)
+		zsshlib.CombineScp(cmd, &flags, cfg)
+
+		remoteDir := ""
+		if strings.Contains(target, ":") {
+			remoteDir = zsshlib.ParseFilePath(target)
+		}
+
+		sshConn := zsshlib.ConnectClient(&flags.SshFlags, target, targetIdentity)
+		defer func() { _ = sshConn.Close() }()
+		client, err := zsshlib.NewSftpClient(sshConn, flags.ChunkSize, flags.MaxRequests)
+		if err != nil {
+			logrus.Fatalf("error creating sftp client: %v", err)
+		}
+		defer func() { _ = client.Close() }()
+
+		session, err := zsshlib.NewSftpSession(client, remoteDir)
+		if err != nil {
+			logrus.Fatalf("%v", err)
+		}
+		stdoutFd := int(os.Stdout.Fd())
+		session.Width, _, _ = terminal.GetSize(stdoutFd)
+		session.Progress = !flags.Quiet && terminal.IsTerminal(stdoutFd)
+		session.Verify = flags.Verify
+		hasher := zsshlib.NewRemoteHasher(sshConn, client)
+		defer func() { _ = hasher.Close() }()
+		session.RemoteChecksum = hasher.Checksum
+
+		var input io.Reader = os.Stdin
+		switch {
+		case batchFile != "" && batchFile != "-":
+			f, err := os.Open(batchFile)
+			if err != nil {
+				logrus.Fatalf("cannot read batch file: %v", err)
+			}
+			defer func() { _ = f.Close() }()
+			input = f
+		case batchFile == "" && terminal.IsTerminal(int(os.Stdin.Fd())):
+			if err := session.RunInteractive(os.Stdin, os.Stdout); err != nil {
+				logrus.Fatalf("%v", err)
+			}
+			return
+		}
+		if err := session.RunBatch(input); err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			_ = client.Close()
+			_ = sshConn.Close()
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	flags.OIDCFlags(rootCmd)
+	flags.ControlFlags(rootCmd)
+	flags.TransferFlags(rootCmd)
+	rootCmd.Flags().StringVarP(&batchFile, "batchFile", "b", "", "read commands from the file, - for stdin, and stop at the first failing command not prefixed with -")
+	rootCmd.Flags().BoolVarP(&flags.Quiet, "quiet", "q", false, "do not show progress bars")
+	rootCmd.Flags().BoolVar(&flags.Verify, "verify", false, "compare the SHA-256 of every file transferred by get and put with its source, hashed on the remote with the check-file sftp extension or sha256sum. fails on mismatches")
+}
+
+func main() {
+	p := common.NewOptionsProvider(os.Stdout, os.Stderr)
+	flags.AddCommonFlags(rootCmd)
+	rootCmd.AddCommand(enroll.NewEnrollIdentityCommand(p))
+	rootCmd.AddCommand(zsshlib.NewMfaCmd(&flags.SshFlags))
+	rootCmd.AddCommand(gendoc.NewGendocCmd(rootCmd))
+	e := rootCmd.Execute()
+	if e != nil {
+		logrus.Error(e)
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"github.com/openziti/ziti/ziti/enroll"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
 
 	"github.com/openziti/cobra-to-md"
 	"github.com/openziti/ziti/ziti/cmd/common"
@@ -60,10 +61,32 @@ var rootCmd = &cobra.Command{
 		cfg := zsshlib.FindConfigByKey(targetIdentity)
 		zsshlib.Combine(cmd, &flags, cfg)
 
+		if flags.ControlCommand != "" {
+			if err := zsshlib.ControlCommand(&flags, args[0], targetIdentity, flags.ControlCommand); err != nil {
+				zsshlib.Logger().Fatal(err)
+			}
+			return
+		}
+
 		cmdArgs := args[1:]
-		sshClient := zsshlib.EstablishClient(&flags, args[0], targetIdentity)
+		sshClient := zsshlib.ConnectClient(&flags, args[0], targetIdentity)
 		defer func() { _ = sshClient.Close() }()
-		if err := zsshlib.RemoteShell(sshClient, cmdArgs); err != nil {
+		if err := zsshlib.StartForwarding(sshClient, &flags); err != nil {
+			zsshlib.Logger().Fatalf("error starting port forwarding: %v", err)
+		}
+		if flags.NoCommand {
+			_ = sshClient.Wait()
+			return
+		}
+		opts := zsshlib.SessionOptions{
+			Pty:          flags.RequestPty(terminal.IsTerminal(int(os.Stdin.Fd()))),
+			ForwardAgent: flags.ForwardAgent,
+		}
+		if err := zsshlib.RemoteShell(sshClient, cmdArgs, opts); err != nil {
+			if code, ok := zsshlib.ExitCode(err); ok {
+				_ = sshClient.Close()
+				os.Exit(code)
+			}
 			zsshlib.Logger().Fatalf("error opening remote shell: %v", err)
 		}
 	},
@@ -71,6 +94,10 @@ var rootCmd = &cobra.Command{
 
 func init() {
 	flags.OIDCFlags(rootCmd)
+	flags.ForwardFlags(rootCmd)
+	flags.SessionFlags(rootCmd)
+	flags.ControlFlags(rootCmd)
+	rootCmd.Flags().StringVarP(&flags.ControlCommand, "controlCommand", "O", "", "Send a command to the control master for <remoteUsername>@<targetIdentity> and exit. One of: check, exit")
 }
 
 // AuthCmd holds the required data for the init cmd
@@ -100,6 +127,8 @@ func (cmd *AuthCmd) Run(_ *cobra.Command, _ []string) error {
 func main() {
 	flags.AddCommonFlags(rootCmd)
 	rootCmd.AddCommand(zsshlib.NewMfaCmd(&flags))
+	rootCmd.AddCommand(zsshlib.NewProxyCmd(&flags))
+	rootCmd.AddCommand(zsshlib.NewKnownHostsCmd())
 	rootCmd.AddCommand(gendoc.NewGendocCmd(rootCmd))
 	p := common.NewOptionsProvider(os.Stdout, os.Stderr)
 	rootCmd.AddCommand(enroll.NewEnrollIdentityCommand(p))
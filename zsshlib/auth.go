@@ -0,0 +1,148 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// ssh authentication method names accepted in preferred_authentications
+const (
+	AuthPublicKey           = "publickey"
+	AuthKeyboardInteractive = "keyboard-interactive"
+	AuthPassword            = "password"
+)
+
+// keyboardInteractiveChallenge answers keyboard-interactive questions, e.g. a PAM OTP prompt, on the terminal
+func keyboardInteractiveChallenge(name string, instruction string, questions []string, echos []bool) ([]string, error) {
+	if name != "" {
+		_, _ = fmt.Fprintln(os.Stderr, name)
+	}
+	if instruction != "" {
+		_, _ = fmt.Fprintln(os.Stderr, instruction)
+	}
+
+	answers := make([]string, len(questions))
+	for i, question := range questions {
+		var err error
+		if echos[i] {
+			answers[i], err = ReadLine(question)
+		} else {
+			answers[i], err = ReadSecret(question)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return answers, nil
+}
+
+func passwordPrompt(user string) func() (string, error) {
+	return func() (string, error) {
+		return ReadSecret(fmt.Sprintf("%s's password: ", user))
+	}
+}
+
+// encryptedKeySigner is the signer for an encrypted private key. Its public key is read from <keyPath>.pub so the
+// key can be offered to the server, and the passphrase is only prompted for once the server accepts the key.
+type encryptedKeySigner struct {
+	publicKey ssh.PublicKey
+	decrypt   func() (ssh.Signer, error)
+}
+
+// newEncryptedKeySigner returns a signer for the encrypted private key in content. When there is no <keyPath>.pub
+// the key has to be decrypted to learn the public key, so the passphrase is prompted for immediately.
+func newEncryptedKeySigner(keyPath string, content []byte, passwordPrompts int) (ssh.Signer, error) {
+	decrypt := encryptedKeyDecrypter(keyPath, content, passwordPrompts)
+
+	pubContent, err := os.ReadFile(keyPath + ".pub")
+	if err != nil {
+		return decrypt()
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(pubContent)
+	if err != nil {
+		log.Debugf("unable to parse public key [%s.pub]: %v", keyPath, err)
+		return decrypt()
+	}
+	return &encryptedKeySigner{
+		publicKey: publicKey,
+		decrypt:   decrypt,
+	}, nil
+}
+
+func (s *encryptedKeySigner) PublicKey() ssh.PublicKey {
+	return s.publicKey
+}
+
+func (s *encryptedKeySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	signer, err := s.decrypt()
+	if err != nil {
+		return nil, err
+	}
+	return signer.Sign(rand, data)
+}
+
+// SignWithAlgorithm allows rsa-sha2-256/512 signatures, servers commonly refuse ssh-rsa (SHA-1)
+func (s *encryptedKeySigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	signer, err := s.decrypt()
+	if err != nil {
+		return nil, err
+	}
+	if as, ok := signer.(ssh.AlgorithmSigner); ok {
+		return as.SignWithAlgorithm(rand, data, algorithm)
+	}
+	return signer.Sign(rand, data)
+}
+
+// encryptedKeyDecrypter returns a func that prompts for the passphrase of an encrypted private key, up to
+// passwordPrompts times. The outcome is remembered so the user is prompted at most once per connection.
+func encryptedKeyDecrypter(keyPath string, content []byte, passwordPrompts int) func() (ssh.Signer, error) {
+	var once sync.Once
+	var signer ssh.Signer
+	var signerErr error
+	return func() (ssh.Signer, error) {
+		once.Do(func() {
+			signerErr = fmt.Errorf("no passphrase accepted for [%s]", keyPath)
+			for i := 0; i < passwordPrompts; i++ {
+				passphrase, err := ReadSecret(fmt.Sprintf("Enter passphrase for key '%s': ", keyPath))
+				if err != nil {
+					signerErr = fmt.Errorf("unable to read passphrase for [%s]: %w", keyPath, err)
+					return
+				}
+				s, err := ssh.ParsePrivateKeyWithPassphrase(content, []byte(passphrase))
+				if err == nil {
+					signer = s
+					signerErr = nil
+					return
+				}
+				if !errors.Is(err, x509.IncorrectPasswordError) {
+					signerErr = fmt.Errorf("error parsing private key from [%s]: %w", keyPath, err)
+					return
+				}
+				log.Warnf("incorrect passphrase for [%s]", keyPath)
+			}
+		})
+		return signer, signerErr
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 
@@ -12,6 +13,13 @@ import (
 	"github.com/openziti/sdk-golang/ziti"
 )
 
+// promptIn and promptOut are used for interactive prompts such as the MFA TOTP code. They are pointed at the
+// controlling terminal by UseTerminalForPrompts when stdin/stdout are carrying data.
+var (
+	promptIn  io.Reader = os.Stdin
+	promptOut io.Writer = os.Stdout
+)
+
 func NewContext(flags *SshFlags, enableMfaListener bool) ziti.Context {
 	oidcToken := ""
 	var oidcErr error
@@ -64,12 +72,15 @@ func NewContext(flags *SshFlags, enableMfaListener bool) ziti.Context {
 
 	if enableMfaListener {
 		ctx.Events().AddMfaTotpCodeListener(func(c ziti.Context, detail *rest_model.AuthQueryDetail, response ziti.MfaCodeResponse) {
+			if flags.BatchMode {
+				log.Fatalf("MFA TOTP required to fully authenticate, not prompting in batch mode")
+			}
 			ok := false
 			for !ok {
-				fmt.Println("MFA TOTP required to fully authenticate")
+				_, _ = fmt.Fprintln(promptOut, "MFA TOTP required to fully authenticate")
 				code := ReadCode(false)
 				if err := response(code); err != nil {
-					fmt.Println("error verifying MFA TOTP: ", err)
+					_, _ = fmt.Fprintln(promptOut, "error verifying MFA TOTP: ", err)
 				} else {
 					ok = true
 				}
@@ -89,11 +100,14 @@ func Auth(ctx ziti.Context) {
 
 func ReadCode(allowEmpty bool) string {
 	code := ""
-	reader := bufio.NewReader(os.Stdin)
+	reader := bufio.NewReader(promptIn)
 	for code == "" {
-		fmt.Print("MFA TOTP code: ")
-		code, _ = reader.ReadString('\n')
-		code = strings.TrimSpace(code)
+		_, _ = fmt.Fprint(promptOut, "MFA TOTP code: ")
+		line, err := reader.ReadString('\n')
+		code = strings.TrimSpace(line)
+		if err != nil && code == "" && !allowEmpty {
+			log.Fatalf("unable to read MFA TOTP code: %v", err)
+		}
 		if allowEmpty {
 			break
 		}
@@ -0,0 +1,130 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const certificateSuffix = "-cert.pub"
+
+// certificateSigners returns the signers to offer for the private key in keyPath. Like OpenSSH, a user certificate
+// for the key is offered before the plain key. The certificate is read from certificateFile when it is set and
+// matches the key, otherwise from <keyPath>-cert.pub.
+func certificateSigners(keyPath string, certificateFile string, signer ssh.Signer) []ssh.Signer {
+	candidates := []string{keyPath + certificateSuffix}
+	if certificateFile != "" {
+		candidates = append([]string{certificateFile}, candidates...)
+	}
+
+	for _, certPath := range candidates {
+		cert, err := loadCertificate(certPath)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Warnf("unable to load certificate [%s]: %v", certPath, err)
+			}
+			continue
+		}
+		if !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+			log.Debugf("certificate [%s] is not for key [%s]", certPath, keyPath)
+			continue
+		}
+		if err := checkCertificateValidity(cert, time.Now()); err != nil {
+			log.Errorf("not using certificate [%s]: %v", certPath, err)
+			continue
+		}
+		certSigner, err := ssh.NewCertSigner(cert, signer)
+		if err != nil {
+			log.Warnf("unable to use certificate [%s]: %v", certPath, err)
+			continue
+		}
+		logCertificate(certPath, cert)
+		return []ssh.Signer{certSigner, signer}
+	}
+	return []ssh.Signer{signer}
+}
+
+func loadCertificate(certPath string) (*ssh.Certificate, error) {
+	content, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(content)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("not an ssh certificate")
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("not a user certificate")
+	}
+	return cert, nil
+}
+
+// checkCertificateValidity returns an error if now is outside the certificate validity window
+func checkCertificateValidity(cert *ssh.Certificate, now time.Time) error {
+	unixNow := uint64(now.Unix())
+	if unixNow < cert.ValidAfter {
+		return fmt.Errorf("certificate is not valid until %s", certificateTime(cert.ValidAfter))
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && unixNow >= cert.ValidBefore {
+		return fmt.Errorf("certificate expired at %s", certificateTime(cert.ValidBefore))
+	}
+	return nil
+}
+
+func certificateTime(t uint64) string {
+	if t == ssh.CertTimeInfinity {
+		return "forever"
+	}
+	return time.Unix(int64(t), 0).Format(time.RFC3339)
+}
+
+func logCertificate(source string, cert *ssh.Certificate) {
+	log.Debugf("using certificate [%s] id %q serial %d principals %v valid from %s to %s",
+		source, cert.KeyId, cert.Serial, cert.ValidPrincipals, certificateTime(cert.ValidAfter), certificateTime(cert.ValidBefore))
+}
+
+// agentSigners returns the signers held by the ssh agent, leaving out certificates that are expired or not yet valid
+func agentSigners(a agent.ExtendedAgent) func() ([]ssh.Signer, error) {
+	return func() ([]ssh.Signer, error) {
+		signers, err := a.Signers()
+		if err != nil {
+			return nil, err
+		}
+		var valid []ssh.Signer
+		for _, signer := range signers {
+			if cert, ok := signer.PublicKey().(*ssh.Certificate); ok {
+				if err := checkCertificateValidity(cert, time.Now()); err != nil {
+					log.Errorf("not using agent certificate %q: %v", cert.KeyId, err)
+					continue
+				}
+				logCertificate("agent", cert)
+			}
+			valid = append(valid, signer)
+		}
+		return valid, nil
+	}
+}
@@ -0,0 +1,55 @@
+package zsshlib
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func signTestCertificate(t *testing.T, key ssh.PublicKey, validAfter time.Time, validBefore time.Time) []byte {
+	_, caKey, _ := ed25519.GenerateKey(rand.Reader)
+	caSigner, _ := ssh.NewSignerFromKey(caKey)
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        ssh.UserCert,
+		KeyId:           "test",
+		ValidPrincipals: []string{"test"},
+		ValidAfter:      uint64(validAfter.Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	assert.NoError(t, cert.SignCert(rand.Reader, caSigner))
+	return ssh.MarshalAuthorizedKey(cert)
+}
+
+func TestCertificateSigners(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(key)
+	keyPath := filepath.Join(t.TempDir(), "id_ed25519")
+
+	result := certificateSigners(keyPath, "", signer)
+	assert.Equal(t, len(result), 1, "only the key expected without a certificate")
+
+	now := time.Now()
+	cert := signTestCertificate(t, signer.PublicKey(), now.Add(-time.Hour), now.Add(time.Hour))
+	assert.NoError(t, os.WriteFile(keyPath+certificateSuffix, cert, 0600))
+	result = certificateSigners(keyPath, "", signer)
+	assert.Equal(t, len(result), 2, "certificate and key expected")
+	_, isCert := result[0].PublicKey().(*ssh.Certificate)
+	assert.True(t, isCert, "certificate should be offered first")
+
+	expired := signTestCertificate(t, signer.PublicKey(), now.Add(-2*time.Hour), now.Add(-time.Hour))
+	assert.NoError(t, os.WriteFile(keyPath+certificateSuffix, expired, 0600))
+	result = certificateSigners(keyPath, "", signer)
+	assert.Equal(t, len(result), 1, "expired certificate should not be used")
+
+	explicit := filepath.Join(t.TempDir(), "explicit-cert.pub")
+	assert.NoError(t, os.WriteFile(explicit, cert, 0600))
+	result = certificateSigners(keyPath, explicit, signer)
+	assert.Equal(t, len(result), 2, "explicit certificate expected")
+}
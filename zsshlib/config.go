@@ -15,16 +15,57 @@ type OIDC struct {
 }
 
 type Config struct {
-	SshKeyPath string `yaml:"ssh_key_path"`
-	ZConfig    string `yaml:"zconfig"`
-	Debug      bool   `yaml:"debug"`
-	Service    string `yaml:"service"`
-	OIDC       OIDC   `yaml:"oidc"`
-	Username   string `yaml:"user"`
+	SshKeyPaths     StringList `yaml:"ssh_key_path"`
+	CertificateFile string     `yaml:"certificate_file"`
+	ZConfig         string     `yaml:"zconfig"`
+	Debug           bool       `yaml:"debug"`
+	Service         string     `yaml:"service"`
+	OIDC            OIDC       `yaml:"oidc"`
+	Username        string     `yaml:"user"`
+	ControlMaster   bool       `yaml:"control_master"`
+	PasswordPrompts int        `yaml:"number_of_password_prompts"`
+	HashKnownHosts  *bool      `yaml:"hash_known_hosts"`
+
+	PreferredAuthentications StringList `yaml:"preferred_authentications"`
+	StrictHostKeyChecking    string     `yaml:"strict_host_key_checking"`
+	HostCAKeys               StringList `yaml:"host_ca_keys"`
+	RevokedHostKeys          string     `yaml:"revoked_host_keys"`
+	ChunkSize                int        `yaml:"sftp_chunk_size"`
+	MaxRequests              int        `yaml:"sftp_max_requests"`
+	ParallelTransfers        int        `yaml:"parallel_transfers"`
 }
 
 type ConfigMap map[string]Config
 
+// StringList is a yaml value that may be given as either a single string or a list of strings
+type StringList []string
+
+func (l *StringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+	if err := unmarshal(&single); err == nil {
+		*l = StringList{single}
+		return nil
+	}
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// defaultIdentityNames are the private keys tried, in order, when no key is configured. matches OpenSSH
+var defaultIdentityNames = []string{"id_ed25519", "id_ecdsa", "id_ecdsa_sk", "id_ed25519_sk", "id_rsa"}
+
+// DefaultIdentityFiles returns the private keys in ~/.ssh that are tried when no key is configured
+func DefaultIdentityFiles() []string {
+	var paths []string
+	for _, name := range defaultIdentityNames {
+		paths = append(paths, filepath.Join(os.Getenv("HOME"), SSH_DIR, name))
+	}
+	return paths
+}
+
 func ConfigHome() string {
 	configHome := os.Getenv("XDG_CONFIG_HOME")
 	if configHome == "" {
@@ -33,6 +74,11 @@ func ConfigHome() string {
 	return configHome
 }
 
+// ControlDir returns the directory holding control master sockets
+func ControlDir() string {
+	return filepath.Join(ConfigHome(), "zssh", "control")
+}
+
 // GetConfigFilePath returns the path to the config file in the ~/.config directory.
 func GetConfigFilePath() string {
 	return filepath.Join(ConfigHome(), "zssh", "config.yaml")
@@ -74,11 +120,12 @@ func SaveConfigs(configs []Config, filePath string) error {
 
 // DefaultConfig returns a default configuration.
 func DefaultConfig() *Config {
+	hashKnownHosts := true
 	return &Config{
-		SshKeyPath: filepath.Join(os.Getenv("HOME"), ".ssh", "id_rsa"),
-		ZConfig:    filepath.Join(os.Getenv("HOME"), ".ziti", "zssh.json"),
-		Debug:      false,
-		Service:    "zssh",
+		SshKeyPaths: DefaultIdentityFiles(),
+		ZConfig:     filepath.Join(os.Getenv("HOME"), ".ziti", "zssh.json"),
+		Debug:       false,
+		Service:     "zssh",
 		OIDC: OIDC{
 			CallbackPort: "63275",
 			ClientID:     "openziti-client",
@@ -86,6 +133,14 @@ func DefaultConfig() *Config {
 			Issuer:       "https://dev-yourid.okta.com",
 			Enabled:      false,
 		},
+		PasswordPrompts: 3,
+		HashKnownHosts:  &hashKnownHosts,
+
+		PreferredAuthentications: []string{AuthPublicKey, AuthKeyboardInteractive, AuthPassword},
+		StrictHostKeyChecking:    StrictHostKeyCheckingAsk,
+		ChunkSize:                DefaultChunkSize,
+		MaxRequests:              DefaultMaxRequests,
+		ParallelTransfers:        1,
 	}
 }
 
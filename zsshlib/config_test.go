@@ -0,0 +1,32 @@
+package zsshlib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestStringList(t *testing.T) {
+	var configs ConfigMap
+	err := yaml.Unmarshal([]byte(`
+single:
+  ssh_key_path: /keys/id_ed25519
+multiple:
+  ssh_key_path:
+    - /keys/id_ed25519
+    - /keys/id_rsa
+`), &configs)
+	assert.NoError(t, err)
+	assert.Equal(t, []string(configs["single"].SshKeyPaths), []string{"/keys/id_ed25519"}, "key paths not correct")
+	assert.Equal(t, []string(configs["multiple"].SshKeyPaths), []string{"/keys/id_ed25519", "/keys/id_rsa"}, "key paths not correct")
+	assert.Empty(t, configs["single"].ZConfig)
+}
+
+func TestDefaultIdentityFiles(t *testing.T) {
+	t.Setenv("HOME", "/home/test")
+	result := DefaultIdentityFiles()
+	assert.Equal(t, len(result), 5, "default identity count not correct")
+	assert.Contains(t, result[0], "id_ed25519", "default identity order not correct")
+	assert.Contains(t, result[4], "id_rsa", "default identity order not correct")
+}
@@ -0,0 +1,386 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// A control master is a background process holding an authenticated ssh.Client for <user>@<targetIdentity>.
+// It listens on a unix socket and runs a minimal ssh server on it: every channel opened by a zssh/zscp client
+// on the socket is opened on the upstream ssh.Client and the two are piped together. Clients skip the ziti
+// authentication, the service dial and the remote ssh handshake. The socket lives in a 0700 directory, so
+// there is no authentication on it and its ephemeral host key is not verified.
+
+const (
+	controlMasterEnv      = "ZSSH_CONTROL_MASTER"
+	controlCheckRequest   = "check@zssh.openziti.io"
+	controlExitRequest    = "exit@zssh.openziti.io"
+	agentForwardRequest   = "auth-agent-req@openssh.com"
+	controlStartupPoll    = 100 * time.Millisecond
+	controlStartupTimeout = 2 * time.Minute // the master may wait on MFA or OIDC prompts before it listens
+	controlCommandCheck   = "check"
+	controlCommandExit    = "exit"
+	controlSocketMaxBytes = 100
+)
+
+type controlCheckReply struct {
+	Pid uint32
+}
+
+// ControlSocketPath returns the socket of the control master for username@targetIdentity on service. Each service
+// on an identity may reach a different ssh server, so they get a master each.
+func ControlSocketPath(username string, targetIdentity string, service string) string {
+	return filepath.Join(ControlDir(), fmt.Sprintf("%s@%s_%s", username, targetIdentity, service))
+}
+
+// ConnectClient returns an ssh.Client for target. Without --controlMaster this is EstablishClient. With it, the
+// client opens its channels on the control master for the target, which is started in the background first if
+// it is not running.
+func ConnectClient(f *SshFlags, target string, targetIdentity string) *ssh.Client {
+	if !f.ControlMaster {
+		return EstablishClient(f, target, targetIdentity)
+	}
+
+	socketPath := ControlSocketPath(f.ResolveUserName(target), targetIdentity, f.ServiceName)
+	if len(socketPath) > controlSocketMaxBytes {
+		log.Warnf("control socket path is too long, not using a control master: %s", socketPath)
+		return EstablishClient(f, target, targetIdentity)
+	}
+
+	if master := os.Getenv(controlMasterEnv); master == socketPath {
+		// this process was started by startControlMaster for this target and never returns to the caller
+		client := EstablishClient(f, target, targetIdentity)
+		detachControlMaster(socketPath + ".log")
+		if err := ServeControlMaster(client, socketPath); err != nil {
+			log.Fatalf("control master failed: %v", err)
+		}
+		os.Exit(0)
+	} else if master != "" {
+		// a master started for another target of the same command, e.g. the other remote of a zscp copy, only
+		// passes through on its way to its own target and never starts masters itself
+		if client, err := DialControlMaster(socketPath); err == nil {
+			return client
+		}
+		return EstablishClient(f, target, targetIdentity)
+	}
+
+	if client, err := DialControlMaster(socketPath); err == nil {
+		log.Debugf("using control master at %s", socketPath)
+		return client
+	}
+
+	if err := startControlMaster(socketPath); err != nil {
+		log.Fatalf("could not start control master: %v", err)
+	}
+	client, err := DialControlMaster(socketPath)
+	if err != nil {
+		log.Fatalf("could not connect to control master at %s: %v", socketPath, err)
+	}
+	return client
+}
+
+// startControlMaster runs this command again in the background as the control master for socketPath and waits
+// until the socket accepts connections, for up to controlStartupTimeout. The child shares stdin/stdout/stderr so MFA and OIDC prompts still work, until it
+// is authenticated and calls detachControlMaster.
+func startControlMaster(socketPath string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), controlMasterEnv+"="+socketPath)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = controlMasterProcAttr()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Debugf("started control master pid=%d", cmd.Process.Pid)
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	ticker := time.NewTicker(controlStartupPoll)
+	defer ticker.Stop()
+	timeout := time.After(controlStartupTimeout)
+	for {
+		select {
+		case err := <-exited:
+			return fmt.Errorf("control master exited before it was ready: %v", err)
+		case <-timeout:
+			_ = cmd.Process.Kill()
+			return fmt.Errorf("control master did not listen on %s within %s", socketPath, controlStartupTimeout)
+		case <-ticker.C:
+			if conn, err := net.Dial("unix", socketPath); err == nil {
+				_ = conn.Close()
+				return nil
+			}
+		}
+	}
+}
+
+// detachControlMaster gives up the stdin, stdout and stderr the control master shares with the command that
+// started it, so a caller reading that command's output until EOF, e.g. out=$(zssh -M ...), does not wait for the
+// master to exit. Later output of the master is appended to logPath.
+func detachControlMaster(logPath string) {
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		log.Warnf("control master could not open %s: %v", os.DevNull, err)
+		return
+	}
+	out := devNull
+	if err := os.MkdirAll(filepath.Dir(logPath), 0700); err == nil {
+		if logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err == nil {
+			out = logFile
+		}
+	}
+	log.SetOutput(out)
+	logrus.SetOutput(out)
+
+	_ = os.Stdin.Close()
+	_ = os.Stdout.Close()
+	_ = os.Stderr.Close()
+	os.Stdin, os.Stdout, os.Stderr = devNull, out, out
+}
+
+// DialControlMaster connects to the control master listening on socketPath
+func DialControlMaster(socketPath string) (*ssh.Client, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ClientConfig{
+		User:            "zssh",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	return Dial(config, conn)
+}
+
+// ControlCommand sends a -O command (check or exit) to the control master for target
+func ControlCommand(f *SshFlags, target string, targetIdentity string, command string) error {
+	var request string
+	switch command {
+	case controlCommandCheck:
+		request = controlCheckRequest
+	case controlCommandExit:
+		request = controlExitRequest
+	default:
+		return fmt.Errorf("unsupported control command [%s]. expected %s or %s", command, controlCommandCheck, controlCommandExit)
+	}
+
+	socketPath := ControlSocketPath(f.ResolveUserName(target), targetIdentity, f.ServiceName)
+	client, err := DialControlMaster(socketPath)
+	if err != nil {
+		return fmt.Errorf("no control master running at %s: %w", socketPath, err)
+	}
+	defer func() { _ = client.Close() }()
+
+	ok, payload, err := client.SendRequest(request, true, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("control master refused %s request", command)
+	}
+
+	if command == controlCommandCheck {
+		reply := controlCheckReply{}
+		if err := ssh.Unmarshal(payload, &reply); err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(os.Stderr, "Master running (pid=%d)\n", reply.Pid)
+	} else {
+		_, _ = fmt.Fprintln(os.Stderr, "Exit request sent.")
+	}
+	return nil
+}
+
+type controlMaster struct {
+	upstream *ssh.Client
+	config   *ssh.ServerConfig
+	listener net.Listener
+	stopOnce sync.Once
+}
+
+// ServeControlMaster listens on socketPath and serves channels on upstream until upstream is closed or an exit
+// request is received. The socket is removed when it returns.
+func ServeControlMaster(upstream *ssh.Client, socketPath string) error {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		return err
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+		return fmt.Errorf("failed to create control directory: %w", err)
+	}
+	// a socket left behind by a master that did not exit cleanly is replaced, a live one is not
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("a control master is already listening on %s", socketPath)
+	}
+	_ = os.Remove(socketPath)
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("could not listen on control socket %s: %w", socketPath, err)
+	}
+	defer func() { _ = os.Remove(socketPath) }()
+
+	m := &controlMaster{
+		upstream: upstream,
+		config:   config,
+		listener: l,
+	}
+	go func() {
+		_ = upstream.Wait()
+		log.Debugf("control master connection closed")
+		m.stop()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return nil
+		}
+		go m.serveConn(conn)
+	}
+}
+
+func (m *controlMaster) stop() {
+	m.stopOnce.Do(func() {
+		_ = m.listener.Close()
+		_ = m.upstream.Close()
+	})
+}
+
+func (m *controlMaster) serveConn(conn net.Conn) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, m.config)
+	if err != nil {
+		log.Debugf("control master handshake failed: %v", err)
+		return
+	}
+	defer func() { _ = sconn.Close() }()
+
+	go m.handleGlobalRequests(reqs)
+	for newChannel := range chans {
+		go m.proxyChannel(newChannel)
+	}
+}
+
+func (m *controlMaster) handleGlobalRequests(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case controlCheckRequest:
+			_ = req.Reply(true, ssh.Marshal(controlCheckReply{Pid: uint32(os.Getpid())}))
+		case controlExitRequest:
+			_ = req.Reply(true, nil)
+			m.stop()
+		default:
+			// tcpip-forward and friends would need channels opened by the remote side routed back to the right
+			// client, which is not supported
+			log.Debugf("control master rejecting global request: %s", req.Type)
+			_ = req.Reply(false, nil)
+		}
+	}
+}
+
+// proxyChannel opens the same channel on the upstream client and pipes data and requests between the two
+func (m *controlMaster) proxyChannel(newChannel ssh.NewChannel) {
+	upstream, upstreamReqs, err := m.upstream.OpenChannel(newChannel.ChannelType(), newChannel.ExtraData())
+	if err != nil {
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) {
+			_ = newChannel.Reject(openErr.Reason, openErr.Message)
+		} else {
+			_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		}
+		return
+	}
+
+	downstream, downstreamReqs, err := newChannel.Accept()
+	if err != nil {
+		_ = upstream.Close()
+		return
+	}
+
+	go func() {
+		for req := range downstreamReqs {
+			if req.Type == agentForwardRequest {
+				// the agent channels the remote side would open are not routed back to this client
+				_ = req.Reply(false, nil)
+				continue
+			}
+			ok, err := upstream.SendRequest(req.Type, req.WantReply, req.Payload)
+			if req.WantReply {
+				_ = req.Reply(ok && err == nil, nil)
+			}
+		}
+		_ = upstream.Close()
+	}()
+
+	go func() {
+		_, _ = io.Copy(upstream, downstream)
+		_ = upstream.CloseWrite()
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(downstream, upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(downstream.Stderr(), upstream.Stderr())
+	}()
+	go func() {
+		defer wg.Done()
+		// exit-status and exit-signal must reach the client before the channel is closed
+		for req := range upstreamReqs {
+			ok, _ := downstream.SendRequest(req.Type, req.WantReply, req.Payload)
+			if req.WantReply {
+				_ = req.Reply(ok, nil)
+			}
+		}
+	}()
+	wg.Wait()
+
+	_ = downstream.CloseWrite()
+	_ = downstream.Close()
+}
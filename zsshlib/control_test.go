@@ -0,0 +1,144 @@
+package zsshlib
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// newEchoUpstream returns a client connected to a loopback ssh server whose exec requests echo the command
+// and exit with status 3
+func newEchoUpstream(t *testing.T) *ssh.Client {
+	_, hostKey, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(hostKey)
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		defer func() { _ = l.Close() }()
+		serverSide, err := l.Accept()
+		if err != nil {
+			return
+		}
+		_, chans, reqs, err := ssh.NewServerConn(serverSide, serverConfig)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		for newChannel := range chans {
+			channel, requests, _ := newChannel.Accept()
+			go func() {
+				for req := range requests {
+					if req.Type != "exec" {
+						_ = req.Reply(false, nil)
+						continue
+					}
+					_ = req.Reply(true, nil)
+					var exec struct{ Command string }
+					_ = ssh.Unmarshal(req.Payload, &exec)
+					_, _ = channel.Write([]byte(exec.Command))
+					_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{3}))
+					_ = channel.Close()
+				}
+			}()
+		}
+	}()
+
+	clientSide, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	client, err := Dial(&ssh.ClientConfig{User: "test", HostKeyCallback: ssh.InsecureIgnoreHostKey()}, clientSide)
+	assert.NoError(t, err)
+	return client
+}
+
+func TestControlMaster(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "test@identity")
+	served := make(chan error, 1)
+	go func() { served <- ServeControlMaster(newEchoUpstream(t), socketPath) }()
+
+	var client *ssh.Client
+	var err error
+	for i := 0; i < 50; i++ {
+		if client, err = DialControlMaster(socketPath); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.NoError(t, err)
+
+	session, err := client.NewSession()
+	assert.NoError(t, err)
+	output, err := session.Output("hello")
+	assert.Equal(t, string(output), "hello", "output not correct")
+	code, ok := ExitCode(err)
+	assert.True(t, ok)
+	assert.Equal(t, code, 3, "exit code not correct")
+
+	// a second master for the socket leaves the running one alone
+	assert.Error(t, ServeControlMaster(nil, socketPath), "live control socket replaced")
+	_, err = client.NewSession()
+	assert.NoError(t, err, "control master unreachable after a second one started")
+
+	ok, _, err = client.SendRequest(controlExitRequest, true, nil)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	select {
+	case err = <-served:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("control master did not exit")
+	}
+	_, err = os.Stat(socketPath)
+	assert.True(t, os.IsNotExist(err), "control socket not removed")
+}
+
+func TestDetachControlMaster(t *testing.T) {
+	if logPath := os.Getenv("ZSSH_TEST_DETACH_LOG"); logPath != "" {
+		// the control master side: detach, then outlive the parent's read of stdout
+		detachControlMaster(logPath)
+		log.Info("detached")
+		time.Sleep(5 * time.Second)
+		os.Exit(0)
+	}
+
+	logPath := filepath.Join(t.TempDir(), "master.log")
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDetachControlMaster$")
+	cmd.Env = append(os.Environ(), "ZSSH_TEST_DETACH_LOG="+logPath)
+	out, err := cmd.StdoutPipe()
+	assert.NoError(t, err)
+	assert.NoError(t, cmd.Start())
+	defer func() { _ = cmd.Process.Kill(); _ = cmd.Wait() }()
+
+	eof := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, out)
+		close(eof)
+	}()
+	select {
+	case <-eof:
+	case <-time.After(3 * time.Second):
+		t.Fatal("stdout of the detached control master was not closed")
+	}
+	// stdout is closed before the child logs
+	assert.Eventually(t, func() bool {
+		content, _ := os.ReadFile(logPath)
+		return strings.Contains(string(content), "detached")
+	}, 3*time.Second, 10*time.Millisecond, "control master log not written")
+}
+
+func TestControlSocketPath(t *testing.T) {
+	assert.NotEqual(t, ControlSocketPath("alice", "server", "zssh"), ControlSocketPath("alice", "server", "other"), "services share a control master")
+}
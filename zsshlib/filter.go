@@ -0,0 +1,120 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// IgnoreFileName is the file in the root of a copied tree that lists patterns to exclude, one per line. Blank
+// lines and lines starting with # are ignored, a pattern starting with ! is an include pattern.
+const IgnoreFileName = ".zscpignore"
+
+// FilterHelp describes --exclude, --include and the ignore file for the commands that take them
+const FilterHelp = "--exclude and --include take shell patterns, matched against the file name or, if the pattern " +
+	"contains a /, the path relative to the copied directory. Files matching an exclude pattern are skipped unless " +
+	"they also match an include pattern. A pattern ending in / matches directories only. Patterns are also read " +
+	"from a " + IgnoreFileName + " file in the copied directory, one per line, ! marking include patterns. With " +
+	"sync --delete, destination files matching the patterns, including those of the source's " + IgnoreFileName + ", " +
+	"are never deleted."
+
+// PathFilter selects the files of a tree to transfer. A path is excluded when it matches an exclude pattern and
+// no include pattern. Excluding a directory excludes everything below it.
+//
+// Patterns are shell globs. A pattern without a / is matched against the last element of the path, one with a /
+// against the whole path relative to the transfer root; a leading / only anchors it there. A trailing / makes
+// the pattern match directories only.
+type PathFilter struct {
+	Excludes []string
+	Includes []string
+}
+
+// Excluded reports whether rel, a slash separated path relative to the transfer root, is filtered out
+func (f *PathFilter) Excluded(rel string, isDir bool) bool {
+	if f == nil {
+		return false
+	}
+	return matchAnyPattern(f.Excludes, rel, isDir) && !matchAnyPattern(f.Includes, rel, isDir)
+}
+
+// WithIgnoreFile returns a copy of f with the patterns of the ignore file at name added. open reads it from the
+// local or remote file system. Without an ignore file f is returned.
+func (f *PathFilter) WithIgnoreFile(open func(name string) (io.ReadCloser, error), name string) (*PathFilter, error) {
+	file, err := open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	filter := &PathFilter{}
+	if f != nil {
+		filter.Excludes = append(filter.Excludes, f.Excludes...)
+		filter.Includes = append(filter.Includes, f.Includes...)
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "!") {
+			filter.Includes = append(filter.Includes, line[1:])
+		} else {
+			filter.Excludes = append(filter.Excludes, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	log.Debugf("read %s: %d exclude and %d include patterns", name, len(filter.Excludes), len(filter.Includes))
+	return filter, nil
+}
+
+func matchAnyPattern(patterns []string, rel string, isDir bool) bool {
+	for _, pattern := range patterns {
+		if matchPattern(pattern, rel, isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPattern(pattern string, rel string, isDir bool) bool {
+	if strings.HasSuffix(pattern, "/") {
+		if !isDir {
+			return false
+		}
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+	name := path.Base(rel)
+	if strings.Contains(pattern, "/") {
+		pattern = strings.TrimPrefix(pattern, "/")
+		name = rel
+	}
+	matched, err := path.Match(pattern, name)
+	if err != nil {
+		log.Warnf("invalid pattern [%s]: %v", pattern, err)
+	}
+	return matched
+}
@@ -9,12 +9,30 @@ import (
 )
 
 type SshFlags struct {
-	ZConfig     string
-	SshKeyPath  string
-	Debug       bool
-	ServiceName string
-	Username    string
-	OIDC        OIDCFlags
+	ZConfig         string
+	SshKeyPaths     []string
+	CertificateFile string
+	Debug           bool
+	ServiceName     string
+	Username        string
+	OIDC            OIDCFlags
+	LocalForwards   []string
+	RemoteForwards  []string
+	DynamicForwards []string
+	NoCommand       bool
+	ForceTTY        bool
+	DisableTTY      bool
+	ForwardAgent    bool
+	ControlMaster   bool
+	ControlCommand  string
+	PasswordPrompts int
+	BatchMode       bool
+	HashKnownHosts  bool
+
+	PreferredAuthentications []string
+	StrictHostKeyChecking    string
+	HostCAKeys               []string
+	RevokedHostKeys          string
 }
 
 type OIDCFlags struct {
@@ -31,7 +49,17 @@ type OIDCFlags struct {
 
 type ScpFlags struct {
 	SshFlags
-	Recursive bool
+	Recursive   bool
+	Quiet       bool
+	Resume      bool
+	Preserve    bool
+	Verify      bool
+	ChunkSize   int
+	MaxRequests int
+	Parallel    int
+	Excludes    []string
+	Includes    []string
+	Links       string
 }
 
 func (f *SshFlags) GetUserAndIdentity(input string) (string, string) {
@@ -41,6 +69,20 @@ func (f *SshFlags) GetUserAndIdentity(input string) (string, string) {
 	return username, targetIdentity
 }
 
+// ResolveUserName returns the remote username: the user in target if present, otherwise the configured username,
+// otherwise the current OS user
+func (f *SshFlags) ResolveUserName(target string) string {
+	username := ParseUserName(target, false)
+	if username == "" {
+		if f.Username == "" {
+			username = ParseUserName(target, true)
+		} else {
+			username = f.Username
+		}
+	}
+	return username
+}
+
 func ParseUserName(input string, returnDefault bool) string {
 	var username string
 	if strings.ContainsAny(input, "@") {
@@ -84,6 +126,23 @@ func ParseFilePath(input string) string {
 	return input
 }
 
+// IsRemotePath reports whether input names a remote file, [user@]identity:path. A single letter before the
+// colon without a user is a windows drive, as in C:\dir, and a path separator before the colon makes it a
+// local file name containing a colon.
+func IsRemotePath(input string) bool {
+	colPos := strings.Index(input, ":")
+	if colPos < 0 || strings.ContainsAny(input[:colPos], `/\`) {
+		return false
+	}
+	return strings.Contains(input[:colPos], "@") || colPos > 1
+}
+
+// TransferFlags registers the sftp tuning flags
+func (f *ScpFlags) TransferFlags(cmd *cobra.Command) {
+	cmd.Flags().IntVarP(&f.ChunkSize, "chunkSize", "B", 0, fmt.Sprintf("bytes per sftp read/write request. sizes over %d may not work with all servers. default: %d", DefaultChunkSize, DefaultChunkSize))
+	cmd.Flags().IntVarP(&f.MaxRequests, "maxRequests", "R", 0, fmt.Sprintf("maximum sftp requests in flight per file. default: %d", DefaultMaxRequests))
+}
+
 // TODO: Add config file support
 func (f *SshFlags) OIDCFlags(cmd *cobra.Command) {
 	defaults := DefaultConfig()
@@ -97,12 +156,44 @@ func (f *SshFlags) OIDCFlags(cmd *cobra.Command) {
 	cmd.Flags().StringArrayVarP(&f.OIDC.AdditionalLoginParams, "additionalLoginParams", "l", []string{}, "Additional parameters to specify to the login. Can specify multiple times. Must be in the format of param=value")
 }
 
+func (f *SshFlags) ForwardFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArrayVarP(&f.LocalForwards, "localForward", "L", []string{}, "Forward a local port to a host:port reachable from the remote. Format: [bind_address:]port:host:hostport. Can specify multiple times")
+	cmd.Flags().StringArrayVarP(&f.RemoteForwards, "remoteForward", "R", []string{}, "Forward a port on the remote to a host:port reachable from the local machine. Format: [bind_address:]port:host:hostport. Can specify multiple times")
+	cmd.Flags().StringArrayVarP(&f.DynamicForwards, "dynamicForward", "D", []string{}, "Run a local SOCKS5 proxy whose connections are made from the remote. Format: [bind_address:]port. Can specify multiple times")
+	cmd.Flags().BoolVarP(&f.NoCommand, "noCommand", "N", false, "Do not execute a remote command or shell. Useful when only forwarding ports")
+}
+
+func (f *SshFlags) SessionFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVarP(&f.ForceTTY, "tty", "t", false, "Force pseudo-terminal allocation, even when stdin is not a terminal")
+	cmd.Flags().BoolVarP(&f.DisableTTY, "noTty", "T", false, "Disable pseudo-terminal allocation. stdin/stdout/stderr are streamed as raw binary data")
+	cmd.Flags().BoolVarP(&f.ForwardAgent, "forwardAgent", "A", false, "Forward the connection to the local ssh agent to the remote session")
+}
+
+// RequestPty reports whether a pseudo-terminal should be requested for the session. Like OpenSSH, -T always
+// wins, -t forces one and otherwise one is only requested when stdin is a terminal.
+func (f *SshFlags) RequestPty(stdinIsTerminal bool) bool {
+	if f.DisableTTY {
+		return false
+	}
+	if f.ForceTTY {
+		return true
+	}
+	return stdinIsTerminal
+}
+
+func (f *SshFlags) ControlFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVarP(&f.ControlMaster, "controlMaster", "M", false, "Open channels on a background control master for <remoteUsername>@<targetIdentity>, starting one if none is running. default: false")
+}
+
 func (f *SshFlags) AddCommonFlags(cmd *cobra.Command) {
 	defaults := DefaultConfig()
 	cmd.Flags().StringVarP(&f.ServiceName, "service", "s", "", fmt.Sprintf("service name. default: %s", defaults.Service))
-	cmd.Flags().StringVarP(&f.SshKeyPath, "SshKeyPath", "i", "", "Path to ssh key. default: $HOME/.ssh/id_rsa")
-	cmd.Flags().StringVarP(&f.ZConfig, "ZConfig", "c", "", fmt.Sprintf("Path to ziti config file. default: "+DefaultIdentityFile()))
+	cmd.Flags().StringArrayVarP(&f.SshKeyPaths, "SshKeyPath", "i", []string{}, "Path to ssh key. Can specify multiple times. default: $HOME/.ssh/"+strings.Join(defaultIdentityNames, ", $HOME/.ssh/"))
+	cmd.Flags().StringVar(&f.CertificateFile, "cert", "", "Path to an ssh certificate for the ssh key. default: <ssh key path>-cert.pub")
+	cmd.Flags().StringVarP(&f.ZConfig, "ZConfig", "c", "", "Path to ziti config file. default: "+DefaultIdentityFile())
 	cmd.Flags().BoolVarP(&f.Debug, "debug", "d", false, "pass to enable any additional debug information")
+	cmd.Flags().BoolVar(&f.BatchMode, "batch", false, "never prompt for passphrases, passwords or MFA codes. for use in scripts")
+	cmd.Flags().StringVar(&f.StrictHostKeyChecking, "strictHostKeyChecking", "", fmt.Sprintf("how unknown and changed host keys are handled: %s. default: %s", strings.Join(StrictHostKeyCheckingModes, "|"), defaults.StrictHostKeyChecking))
 
 	/*
 		if f.SshKeyPath == "" {
@@ -125,6 +216,33 @@ func (f *SshFlags) AddCommonFlags(cmd *cobra.Command) {
 	*/
 }
 
+// CombineScp merges the file transfer flags with the config, see Combine
+func CombineScp(cmd *cobra.Command, c *ScpFlags, cfg *Config) {
+	Combine(cmd, &c.SshFlags, cfg)
+	d := DefaultConfig()
+	if c.ChunkSize == 0 {
+		if cfg.ChunkSize == 0 {
+			c.ChunkSize = d.ChunkSize
+		} else {
+			c.ChunkSize = cfg.ChunkSize
+		}
+	}
+	if c.MaxRequests == 0 {
+		if cfg.MaxRequests == 0 {
+			c.MaxRequests = d.MaxRequests
+		} else {
+			c.MaxRequests = cfg.MaxRequests
+		}
+	}
+	if c.Parallel == 0 {
+		if cfg.ParallelTransfers == 0 {
+			c.Parallel = d.ParallelTransfers
+		} else {
+			c.Parallel = cfg.ParallelTransfers
+		}
+	}
+}
+
 func Combine(cmd *cobra.Command, c *SshFlags, cfg *Config) {
 	d := DefaultConfig()
 	if c.ZConfig == "" {
@@ -134,13 +252,16 @@ func Combine(cmd *cobra.Command, c *SshFlags, cfg *Config) {
 			c.ZConfig = cfg.ZConfig
 		}
 	}
-	if c.SshKeyPath == "" {
-		if cfg.SshKeyPath == "" {
-			c.SshKeyPath = d.SshKeyPath
+	if len(c.SshKeyPaths) == 0 {
+		if len(cfg.SshKeyPaths) == 0 {
+			c.SshKeyPaths = d.SshKeyPaths
 		} else {
-			c.SshKeyPath = cfg.SshKeyPath
+			c.SshKeyPaths = cfg.SshKeyPaths
 		}
 	}
+	if c.CertificateFile == "" {
+		c.CertificateFile = cfg.CertificateFile
+	}
 	if c.ServiceName == "" {
 		c.ServiceName = cfg.Service
 		if cfg.Service == "" {
@@ -160,6 +281,45 @@ func Combine(cmd *cobra.Command, c *SshFlags, cfg *Config) {
 	if !cmd.Flags().Changed("oidc") {
 		c.OIDC.Mode = cfg.OIDC.Enabled
 	}
+	if c.PasswordPrompts == 0 {
+		if cfg.PasswordPrompts == 0 {
+			c.PasswordPrompts = d.PasswordPrompts
+		} else {
+			c.PasswordPrompts = cfg.PasswordPrompts
+		}
+	}
+	if len(c.PreferredAuthentications) == 0 {
+		if len(cfg.PreferredAuthentications) == 0 {
+			c.PreferredAuthentications = d.PreferredAuthentications
+		} else {
+			c.PreferredAuthentications = cfg.PreferredAuthentications
+		}
+	}
+	if c.StrictHostKeyChecking == "" {
+		if cfg.StrictHostKeyChecking == "" {
+			c.StrictHostKeyChecking = d.StrictHostKeyChecking
+		} else {
+			c.StrictHostKeyChecking = cfg.StrictHostKeyChecking
+		}
+	}
+	// a typo would otherwise only show once a host key is unknown
+	if err := CheckStrictHostKeyChecking(c.StrictHostKeyChecking); err != nil {
+		log.Fatal(err)
+	}
+	if len(c.HostCAKeys) == 0 {
+		c.HostCAKeys = cfg.HostCAKeys
+	}
+	if c.RevokedHostKeys == "" {
+		c.RevokedHostKeys = cfg.RevokedHostKeys
+	}
+	if cfg.HashKnownHosts == nil {
+		c.HashKnownHosts = *d.HashKnownHosts
+	} else {
+		c.HashKnownHosts = *cfg.HashKnownHosts
+	}
+	if !cmd.Flags().Changed("controlMaster") {
+		c.ControlMaster = cfg.ControlMaster
+	}
 	if c.OIDC.Mode {
 		if c.OIDC.Issuer == "" {
 			c.OIDC.Issuer = cfg.OIDC.Issuer
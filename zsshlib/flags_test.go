@@ -59,3 +59,28 @@ func TestParseFilePath(t *testing.T) {
 	result = ParseFilePath(`user@hostname:/haha://two\:colons`)
 	assert.Equal(t, result, `/haha://two\:colons`, "user not correct")
 }
+
+func TestIsRemotePath(t *testing.T) {
+	assert.True(t, IsRemotePath("user@hostname:/bob"), "user@identity:path not remote")
+	assert.True(t, IsRemotePath("hostname:/bob"), "identity:path not remote")
+	assert.True(t, IsRemotePath("user@h:bob"), "user@ with a one letter identity not remote")
+	assert.True(t, IsRemotePath("hostname:"), "identity: not remote")
+	assert.False(t, IsRemotePath(`C:\dir`), "windows drive is remote")
+	assert.False(t, IsRemotePath("c:/dir/file"), "windows drive is remote")
+	assert.False(t, IsRemotePath("C:"), "windows drive is remote")
+	assert.False(t, IsRemotePath("./a:b"), "local name with a colon is remote")
+	assert.False(t, IsRemotePath(`dir\a:b`), "local name with a colon is remote")
+	assert.False(t, IsRemotePath("file.txt"), "local name is remote")
+}
+
+func TestRequestPty(t *testing.T) {
+	f := SshFlags{}
+	assert.True(t, f.RequestPty(true), "pty expected when stdin is a terminal")
+	assert.False(t, f.RequestPty(false), "pty not expected when stdin is not a terminal")
+
+	f.ForceTTY = true
+	assert.True(t, f.RequestPty(false), "pty expected when forced")
+
+	f.DisableTTY = true
+	assert.False(t, f.RequestPty(true), "pty not expected when disabled")
+}
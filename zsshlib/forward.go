@@ -0,0 +1,374 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultForwardBindHost = "localhost"
+
+	socks5Version          = 0x05
+	socks5NoAuth           = 0x00
+	socks5NoAcceptable     = 0xff
+	socks5CmdConnect       = 0x01
+	socks5AddrIPv4         = 0x01
+	socks5AddrDomain       = 0x03
+	socks5AddrIPv6         = 0x04
+	socks5Succeeded        = 0x00
+	socks5GeneralFailure   = 0x01
+	socks5CmdNotSupported  = 0x07
+	socks5AddrNotSupported = 0x08
+)
+
+// ForwardSpec is a parsed -L or -R argument. BindAddress is where the listener is opened (locally for -L,
+// on the remote sshd for -R) and Destination is where accepted connections are sent.
+type ForwardSpec struct {
+	BindAddress string
+	Destination string
+}
+
+// ParseForwardSpec parses an OpenSSH style [bind_address:]port:host:hostport forwarding argument. IPv6
+// addresses may be given in square brackets. An empty or "*" bind_address binds to all interfaces.
+func ParseForwardSpec(spec string) (*ForwardSpec, error) {
+	parts, err := splitForwardSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	var bindHost string
+	switch len(parts) {
+	case 3:
+		bindHost = defaultForwardBindHost
+	case 4:
+		bindHost = parts[0]
+		parts = parts[1:]
+	default:
+		return nil, fmt.Errorf("invalid forward specification [%s]: expected [bind_address:]port:host:hostport", spec)
+	}
+
+	if _, err := parsePort(parts[0]); err != nil {
+		return nil, fmt.Errorf("invalid listen port in forward specification [%s]: %w", spec, err)
+	}
+	if parts[1] == "" {
+		return nil, fmt.Errorf("invalid forward specification [%s]: missing destination host", spec)
+	}
+	if _, err := parsePort(parts[2]); err != nil {
+		return nil, fmt.Errorf("invalid destination port in forward specification [%s]: %w", spec, err)
+	}
+
+	return &ForwardSpec{
+		BindAddress: net.JoinHostPort(wildcardBindHost(bindHost), parts[0]),
+		Destination: net.JoinHostPort(parts[1], parts[2]),
+	}, nil
+}
+
+// ParseDynamicSpec parses an OpenSSH style [bind_address:]port argument to -D and returns the address the
+// SOCKS listener should bind to.
+func ParseDynamicSpec(spec string) (string, error) {
+	parts, err := splitForwardSpec(spec)
+	if err != nil {
+		return "", err
+	}
+
+	bindHost := defaultForwardBindHost
+	switch len(parts) {
+	case 1:
+	case 2:
+		bindHost = parts[0]
+		parts = parts[1:]
+	default:
+		return "", fmt.Errorf("invalid dynamic forward specification [%s]: expected [bind_address:]port", spec)
+	}
+
+	if _, err := parsePort(parts[0]); err != nil {
+		return "", fmt.Errorf("invalid port in dynamic forward specification [%s]: %w", spec, err)
+	}
+	return net.JoinHostPort(wildcardBindHost(bindHost), parts[0]), nil
+}
+
+// splitForwardSpec splits on ':' while keeping bracketed IPv6 addresses intact
+func splitForwardSpec(spec string) ([]string, error) {
+	var parts []string
+	var current strings.Builder
+	inBrackets := false
+	for _, r := range spec {
+		switch {
+		case r == '[' && !inBrackets:
+			inBrackets = true
+		case r == ']' && inBrackets:
+			inBrackets = false
+		case r == ':' && !inBrackets:
+			parts = append(parts, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if inBrackets {
+		return nil, fmt.Errorf("invalid forward specification [%s]: unterminated '['", spec)
+	}
+	return append(parts, current.String()), nil
+}
+
+func parsePort(port string) (int, error) {
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return 0, err
+	}
+	if p < 0 || p > 65535 {
+		return 0, fmt.Errorf("port %d out of range", p)
+	}
+	return p, nil
+}
+
+func wildcardBindHost(host string) string {
+	if host == "" || host == "*" {
+		return "0.0.0.0"
+	}
+	return host
+}
+
+// StartForwarding opens every listener requested by the -L, -R and -D flags. Listeners are served in the
+// background for the lifetime of the ssh.Client. An error is returned if any listener cannot be opened.
+func StartForwarding(client *ssh.Client, f *SshFlags) error {
+	for _, spec := range f.LocalForwards {
+		fwd, err := ParseForwardSpec(spec)
+		if err != nil {
+			return err
+		}
+		if err := LocalForward(client, fwd); err != nil {
+			return err
+		}
+	}
+	for _, spec := range f.RemoteForwards {
+		fwd, err := ParseForwardSpec(spec)
+		if err != nil {
+			return err
+		}
+		if err := RemoteForward(client, fwd); err != nil {
+			return err
+		}
+	}
+	for _, spec := range f.DynamicForwards {
+		bindAddress, err := ParseDynamicSpec(spec)
+		if err != nil {
+			return err
+		}
+		if err := DynamicForward(client, bindAddress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LocalForward listens on fwd.BindAddress locally and sends each accepted connection to fwd.Destination
+// through the remote sshd
+func LocalForward(client *ssh.Client, fwd *ForwardSpec) error {
+	l, err := net.Listen("tcp", fwd.BindAddress)
+	if err != nil {
+		return fmt.Errorf("could not listen on [%s] for local forward: %w", fwd.BindAddress, err)
+	}
+	log.Debugf("local forward listening on %s => %s", l.Addr(), fwd.Destination)
+
+	go serveForward(l, func(local net.Conn) {
+		remote, err := client.Dial("tcp", fwd.Destination)
+		if err != nil {
+			log.Errorf("local forward could not connect to [%s]: %v", fwd.Destination, err)
+			_ = local.Close()
+			return
+		}
+		pipeConns(local, remote)
+	})
+	return nil
+}
+
+// RemoteForward asks the remote sshd to listen on fwd.BindAddress and sends each connection it accepts to
+// fwd.Destination from the local machine
+func RemoteForward(client *ssh.Client, fwd *ForwardSpec) error {
+	l, err := client.Listen("tcp", fwd.BindAddress)
+	if err != nil {
+		return fmt.Errorf("could not listen on remote [%s] for remote forward: %w", fwd.BindAddress, err)
+	}
+	log.Debugf("remote forward listening on %s => %s", l.Addr(), fwd.Destination)
+
+	go serveForward(l, func(remote net.Conn) {
+		local, err := net.Dial("tcp", fwd.Destination)
+		if err != nil {
+			log.Errorf("remote forward could not connect to [%s]: %v", fwd.Destination, err)
+			_ = remote.Close()
+			return
+		}
+		pipeConns(remote, local)
+	})
+	return nil
+}
+
+// DynamicForward runs a SOCKS5 server on bindAddress locally. Connections requested through it are made
+// by the remote sshd.
+func DynamicForward(client *ssh.Client, bindAddress string) error {
+	l, err := net.Listen("tcp", bindAddress)
+	if err != nil {
+		return fmt.Errorf("could not listen on [%s] for dynamic forward: %w", bindAddress, err)
+	}
+	log.Debugf("dynamic forward (SOCKS5) listening on %s", l.Addr())
+
+	go serveForward(l, func(local net.Conn) {
+		if err := socks5Connect(client, local); err != nil {
+			log.Errorf("dynamic forward failed: %v", err)
+			_ = local.Close()
+		}
+	})
+	return nil
+}
+
+func serveForward(l net.Listener, handle func(net.Conn)) {
+	defer func() { _ = l.Close() }()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Debugf("forward listener on %s closed: %v", l.Addr(), err)
+			return
+		}
+		go handle(conn)
+	}
+}
+
+// pipeConns copies in both directions until either side is done, then closes both
+func pipeConns(a net.Conn, b net.Conn) {
+	var once sync.Once
+	closeBoth := func() {
+		_ = a.Close()
+		_ = b.Close()
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(a, b)
+		once.Do(closeBoth)
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(b, a)
+		once.Do(closeBoth)
+	}()
+	wg.Wait()
+}
+
+// socks5Connect performs a no-auth SOCKS5 handshake on conn (RFC 1928), dials the requested CONNECT
+// destination through the ssh.Client and pipes the two together
+func socks5Connect(client *ssh.Client, conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("could not read SOCKS greeting: %w", err)
+	}
+	if header[0] != socks5Version {
+		return fmt.Errorf("unsupported SOCKS version: %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return fmt.Errorf("could not read SOCKS auth methods: %w", err)
+	}
+	noAuth := false
+	for _, m := range methods {
+		if m == socks5NoAuth {
+			noAuth = true
+		}
+	}
+	if !noAuth {
+		_, _ = conn.Write([]byte{socks5Version, socks5NoAcceptable})
+		return fmt.Errorf("SOCKS client does not support the no authentication method")
+	}
+	if _, err := conn.Write([]byte{socks5Version, socks5NoAuth}); err != nil {
+		return err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return fmt.Errorf("could not read SOCKS request: %w", err)
+	}
+	if request[0] != socks5Version {
+		return fmt.Errorf("unsupported SOCKS version: %d", request[0])
+	}
+	if request[1] != socks5CmdConnect {
+		_ = socks5Reply(conn, socks5CmdNotSupported)
+		return fmt.Errorf("unsupported SOCKS command: %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		size := net.IPv4len
+		if request[3] == socks5AddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return fmt.Errorf("could not read SOCKS address: %w", err)
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return fmt.Errorf("could not read SOCKS address: %w", err)
+		}
+		domain := make([]byte, size[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return fmt.Errorf("could not read SOCKS address: %w", err)
+		}
+		host = string(domain)
+	default:
+		_ = socks5Reply(conn, socks5AddrNotSupported)
+		return fmt.Errorf("unsupported SOCKS address type: %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return fmt.Errorf("could not read SOCKS port: %w", err)
+	}
+	destination := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	remote, err := client.Dial("tcp", destination)
+	if err != nil {
+		_ = socks5Reply(conn, socks5GeneralFailure)
+		return fmt.Errorf("could not connect to [%s]: %w", destination, err)
+	}
+	if err := socks5Reply(conn, socks5Succeeded); err != nil {
+		_ = remote.Close()
+		return err
+	}
+	log.Debugf("dynamic forward connected to %s", destination)
+
+	pipeConns(conn, remote)
+	return nil
+}
+
+// socks5Reply writes a reply with an unspecified IPv4 bind address, which clients ignore for CONNECT
+func socks5Reply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{socks5Version, status, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
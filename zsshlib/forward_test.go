@@ -0,0 +1,57 @@
+package zsshlib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseForwardSpec(t *testing.T) {
+	result, err := ParseForwardSpec("8080:db.internal:5432")
+	assert.NoError(t, err)
+	assert.Equal(t, result.BindAddress, "localhost:8080", "bind address not correct")
+	assert.Equal(t, result.Destination, "db.internal:5432", "destination not correct")
+
+	result, err = ParseForwardSpec("127.0.0.2:8080:localhost:80")
+	assert.NoError(t, err)
+	assert.Equal(t, result.BindAddress, "127.0.0.2:8080", "bind address not correct")
+	assert.Equal(t, result.Destination, "localhost:80", "destination not correct")
+
+	result, err = ParseForwardSpec("*:8080:localhost:80")
+	assert.NoError(t, err)
+	assert.Equal(t, result.BindAddress, "0.0.0.0:8080", "bind address not correct")
+
+	result, err = ParseForwardSpec(":8080:localhost:80")
+	assert.NoError(t, err)
+	assert.Equal(t, result.BindAddress, "0.0.0.0:8080", "bind address not correct")
+
+	result, err = ParseForwardSpec("[::1]:8080:[fd00::5]:443")
+	assert.NoError(t, err)
+	assert.Equal(t, result.BindAddress, "[::1]:8080", "bind address not correct")
+	assert.Equal(t, result.Destination, "[fd00::5]:443", "destination not correct")
+
+	_, err = ParseForwardSpec("8080:localhost")
+	assert.Error(t, err)
+
+	_, err = ParseForwardSpec("http:localhost:80")
+	assert.Error(t, err)
+
+	_, err = ParseForwardSpec("8080:localhost:99999")
+	assert.Error(t, err)
+
+	_, err = ParseForwardSpec("[::1:8080:localhost:80")
+	assert.Error(t, err)
+}
+
+func TestParseDynamicSpec(t *testing.T) {
+	result, err := ParseDynamicSpec("1080")
+	assert.NoError(t, err)
+	assert.Equal(t, result, "localhost:1080", "bind address not correct")
+
+	result, err = ParseDynamicSpec("0.0.0.0:1080")
+	assert.NoError(t, err)
+	assert.Equal(t, result, "0.0.0.0:1080", "bind address not correct")
+
+	_, err = ParseDynamicSpec("a:b:c")
+	assert.Error(t, err)
+}
@@ -0,0 +1,683 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const hashedHostPrefix = "|1|"
+
+// StrictHostKeyChecking modes, see KnownHosts.StrictHostKeyChecking
+const (
+	// StrictHostKeyCheckingYes refuses hosts whose key is not in known_hosts
+	StrictHostKeyCheckingYes = "yes"
+	// StrictHostKeyCheckingNo adds unknown keys and connects, with a warning, even when the key has changed
+	StrictHostKeyCheckingNo = "no"
+	// StrictHostKeyCheckingAcceptNew adds unknown keys but refuses changed keys
+	StrictHostKeyCheckingAcceptNew = "accept-new"
+	// StrictHostKeyCheckingAsk prompts before adding unknown keys and refuses changed keys
+	StrictHostKeyCheckingAsk = "ask"
+)
+
+var StrictHostKeyCheckingModes = []string{StrictHostKeyCheckingYes, StrictHostKeyCheckingNo, StrictHostKeyCheckingAcceptNew, StrictHostKeyCheckingAsk}
+
+// KnownHosts verifies host keys against an OpenSSH known_hosts file and manages its entries
+type KnownHosts struct {
+	// File is the known_hosts file. default: ~/.ssh/known_hosts
+	File string
+	// Alias is the name host keys are recorded under, see KnownHostsAlias. default: the edge router address
+	Alias string
+	// StrictHostKeyChecking is how unknown and changed host keys are handled, one of StrictHostKeyCheckingModes.
+	// default: ask
+	StrictHostKeyChecking string
+	// Principal is the name host certificates must be issued to, the target identity
+	Principal string
+	// HostCAKeys are trusted host certificate authorities in addition to @cert-authority entries. Each is a
+	// public key or the path of a file of public keys.
+	HostCAKeys []string
+	// RevokedHostKeys is an OpenSSH KRL or a file of public keys that must never be accepted
+	RevokedHostKeys string
+	// Hash writes new entries with OpenSSH hashed host names (|1|salt|hash) instead of in plain text
+	Hash bool
+}
+
+// KnownHostEntry is one host key line of a known_hosts file
+type KnownHostEntry struct {
+	Line    int
+	Marker  string
+	Hosts   []string
+	Key     ssh.PublicKey
+	Comment string
+}
+
+type zitiEdgeConnAdapter struct {
+	orig net.Addr
+}
+
+func (a zitiEdgeConnAdapter) Network() string {
+	return ""
+}
+func (a zitiEdgeConnAdapter) String() string {
+	// ziti connections will have the format: "ziti-edge-router connId=%v, logical=%v", e.MsgCh.Id(), e.MsgCh.LogicalName()
+	// see ziti/edge/addr.go in github.com/openziti/sdk-golang if it changes
+	// example: ziti-edge-router connId=1, logical=ziti-sdk[router=tls:ec2-3-18-113-172.us-east-2.compute.amazonaws.com:8442]
+	parts := strings.Split(a.orig.String(), ":")
+	answer := strings.Join(parts[len(parts)-2:], ":")
+	answer = strings.ReplaceAll(answer, "]", "")
+	return answer
+}
+
+func keyToString(k ssh.PublicKey) string {
+	return k.Type() + " " + base64.StdEncoding.EncodeToString(k.Marshal())
+}
+
+func (k *KnownHosts) file() string {
+	if k.File == "" {
+		return knownHostsFile()
+	}
+	return k.File
+}
+
+// KnownHostsAlias returns the name host keys of targetIdentity are recorded under in known_hosts, e.g.
+// [zssh:myhost]. The edge router a connection happens to use is not part of it, so the same identity is
+// recognized through any router and identities behind one router don't share an entry.
+func KnownHostsAlias(service string, targetIdentity string) string {
+	return "[" + service + ":" + targetIdentity + "]"
+}
+
+// knownHostAddress returns name in the host:port form the knownhosts callback checks against
+func knownHostAddress(name string) string {
+	host, port, err := net.SplitHostPort(name)
+	if err != nil {
+		host = name
+		port = "22"
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return net.JoinHostPort(host, port)
+}
+
+// knownHostEntryName returns the plain-text known_hosts form of name. It is knownhosts.Normalize, except that a
+// host containing ':' keeps its port so the entry is parsed back as a single host, e.g. [zssh:myhost]:22.
+func knownHostEntryName(name string) string {
+	normalized := knownhosts.Normalize(name)
+	if !strings.HasPrefix(normalized, "[") && strings.Contains(normalized, ":") {
+		return knownHostAddress(name)
+	}
+	return normalized
+}
+
+func (k *KnownHosts) HostKeyCallback(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	remoteCopy := zitiEdgeConnAdapter{
+		orig: remote,
+	}
+	name := k.Alias
+	if name == "" {
+		name = remoteCopy.String()
+	}
+
+	if err := ensureKnownHosts(k.file()); err != nil {
+		return err
+	}
+
+	cb, err := knownhosts.New(k.file())
+	if err != nil {
+		return err
+	}
+
+	if err := k.checkRevoked(name, key); err != nil {
+		return err
+	}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		authorities, err := k.hostAuthorities(name)
+		if err != nil {
+			return err
+		}
+		if len(authorities) > 0 {
+			return k.checkHostCertificate(name, remote, cert, authorities)
+		}
+		// like OpenSSH, without a trusted CA the key of the certificate is checked as a plain host key
+		log.Debugf("no certificate authority is known for %s, checking the certified key instead", name)
+		key = cert.Key
+	}
+
+	err = cb(knownHostAddress(name), remoteCopy, key)
+	if err == nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		// includes keys marked @revoked
+		return fmt.Errorf("host key verification failed for %s: %w", name, err)
+	}
+	// If keyErr.Want is greater than 0 length, that means host is in file with different key.
+	if len(keyErr.Want) > 0 {
+		return k.hostKeyChanged(name, key, keyErr)
+	}
+
+	if k.Alias != "" {
+		// before entries were keyed on the target identity they were recorded under the edge router address.
+		// a key that matches the router entry is trusted and recorded under the identity from now on.
+		if legacyErr := cb("", remoteCopy, key); legacyErr == nil {
+			if adderr := k.Add(name, key); adderr != nil {
+				return fmt.Errorf("error adding key to known_hosts: %w", adderr)
+			}
+			log.Infof("host key for %s was recorded under edge router address %s, it is now recorded as %s. "+
+				"the old entry can be removed with: zssh known-hosts remove %s", name, remoteCopy.String(), name, remoteCopy.String())
+			return nil
+		}
+	}
+
+	return k.hostKeyUnknown(name, key)
+}
+
+// checkRevoked returns an error when key, or the certificate and its CA, is in an @revoked entry or the
+// RevokedHostKeys list
+func (k *KnownHosts) checkRevoked(name string, key ssh.PublicKey) error {
+	candidates := []ssh.PublicKey{key}
+	cert, isCert := key.(*ssh.Certificate)
+	if isCert {
+		candidates = append(candidates, cert.Key, cert.SignatureKey)
+	}
+
+	entries, err := k.Entries()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Marker != "revoked" {
+			continue
+		}
+		for _, candidate := range candidates {
+			if bytes.Equal(entry.Key.Marshal(), candidate.Marshal()) {
+				return fmt.Errorf("host key verification failed: %s key %s for %s is marked as revoked in %s:%d",
+					keyTypeName(candidate), ssh.FingerprintSHA256(candidate), name, k.file(), entry.Line)
+			}
+		}
+	}
+
+	if k.RevokedHostKeys == "" {
+		return nil
+	}
+	rl, err := loadRevocationList(k.RevokedHostKeys)
+	if err != nil {
+		return fmt.Errorf("host key verification failed: unable to load revoked host keys: %w", err)
+	}
+	revoked := false
+	if isCert {
+		revoked = rl.certRevoked(cert) || rl.keyRevoked(cert.SignatureKey)
+	} else {
+		revoked = rl.keyRevoked(key)
+	}
+	if revoked {
+		return fmt.Errorf("host key verification failed: %s key %s for %s is revoked by %s",
+			keyTypeName(key), ssh.FingerprintSHA256(key), name, k.RevokedHostKeys)
+	}
+	return nil
+}
+
+// hostAuthorities returns the CA keys trusted to sign host certificates for name
+func (k *KnownHosts) hostAuthorities(name string) ([]ssh.PublicKey, error) {
+	var authorities []ssh.PublicKey
+	entries, err := k.Entries()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.Marker == "cert-authority" && entry.Matches(name) {
+			authorities = append(authorities, entry.Key)
+		}
+	}
+
+	for _, caKey := range k.HostCAKeys {
+		if key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(caKey)); err == nil {
+			authorities = append(authorities, key)
+			continue
+		}
+		content, err := os.ReadFile(caKey)
+		if err != nil {
+			return nil, fmt.Errorf("host_ca_keys entry is neither a public key nor a readable file: %w", err)
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+			if err != nil {
+				return nil, fmt.Errorf("invalid host CA key in [%s]: %w", caKey, err)
+			}
+			authorities = append(authorities, key)
+		}
+	}
+	return authorities, nil
+}
+
+// checkHostCertificate verifies that cert is a host certificate signed by one of authorities and issued to
+// k.Principal
+func (k *KnownHosts) checkHostCertificate(name string, remote net.Addr, cert *ssh.Certificate, authorities []ssh.PublicKey) error {
+	principal := k.Principal
+	if principal == "" {
+		principal = knownhosts.Normalize(name)
+	}
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			for _, authority := range authorities {
+				if bytes.Equal(authority.Marshal(), auth.Marshal()) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+	if err := checker.CheckHostKey(net.JoinHostPort(principal, "22"), remote, cert); err != nil {
+		return fmt.Errorf("host key verification failed: host certificate for %s was rejected: %w", name, err)
+	}
+	log.Debugf("host certificate %q serial %d for %s is signed by trusted CA %s",
+		cert.KeyId, cert.Serial, name, ssh.FingerprintSHA256(cert.SignatureKey))
+	return nil
+}
+
+// CheckStrictHostKeyChecking returns an error naming the valid modes when mode is not one of
+// StrictHostKeyCheckingModes
+func CheckStrictHostKeyChecking(mode string) error {
+	for _, valid := range StrictHostKeyCheckingModes {
+		if mode == valid {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid strict host key checking mode %q, expected one of: %s", mode,
+		strings.Join(StrictHostKeyCheckingModes, ", "))
+}
+
+func (k *KnownHosts) strictHostKeyChecking() string {
+	if k.StrictHostKeyChecking == "" {
+		return StrictHostKeyCheckingAsk
+	}
+	return k.StrictHostKeyChecking
+}
+
+// hostKeyUnknown decides, according to the StrictHostKeyChecking mode, whether to trust a host key seen for
+// the first time. A trusted key is added to the known_hosts file.
+func (k *KnownHosts) hostKeyUnknown(name string, key ssh.PublicKey) error {
+	fingerprint := ssh.FingerprintSHA256(key)
+	switch k.strictHostKeyChecking() {
+	case StrictHostKeyCheckingYes:
+		return fmt.Errorf("host key verification failed: no host key is known for %s and strict host key checking is enabled. "+
+			"%s key fingerprint is %s", name, keyTypeName(key), fingerprint)
+	case StrictHostKeyCheckingNo, StrictHostKeyCheckingAcceptNew:
+		if err := k.Add(name, key); err != nil {
+			return fmt.Errorf("error adding key to known_hosts: %w", err)
+		}
+		log.Warnf("permanently added %s (%s %s) to the list of known hosts", name, keyTypeName(key), fingerprint)
+		return nil
+	case StrictHostKeyCheckingAsk:
+		_, _ = fmt.Fprintf(os.Stderr, "The authenticity of host '%s' can't be established.\n", name)
+		_, _ = fmt.Fprintf(os.Stderr, "%s key fingerprint is %s.\n", keyTypeName(key), fingerprint)
+		_, _ = fmt.Fprintln(os.Stderr, RandomArt(key))
+		prompt := "Are you sure you want to continue connecting (yes/no/[fingerprint])? "
+		for {
+			answer, err := ReadLine(prompt)
+			if err != nil {
+				return fmt.Errorf("host key verification failed: unable to confirm host key for %s: %w", name, err)
+			}
+			answer = strings.TrimSpace(answer)
+			switch strings.ToLower(answer) {
+			case "yes", "y":
+			case "no", "n", "":
+				return fmt.Errorf("host key verification failed: host key for %s was not accepted", name)
+			default:
+				if answer != fingerprint {
+					prompt = "Please type 'yes', 'no' or the fingerprint: "
+					continue
+				}
+			}
+			break
+		}
+		if err := k.Add(name, key); err != nil {
+			return fmt.Errorf("error adding key to known_hosts: %w", err)
+		}
+		log.Infof("added key to known_hosts: %s", keyToString(key))
+		return nil
+	default:
+		return CheckStrictHostKeyChecking(k.StrictHostKeyChecking)
+	}
+}
+
+// hostKeyChanged warns that the host key differs from the known one. The connection is refused unless strict
+// host key checking is off.
+func (k *KnownHosts) hostKeyChanged(name string, key ssh.PublicKey, keyErr *knownhosts.KeyError) error {
+	banner := strings.Repeat("@", 59)
+	_, _ = fmt.Fprintln(os.Stderr, banner)
+	_, _ = fmt.Fprintln(os.Stderr, "@    WARNING: REMOTE HOST IDENTIFICATION HAS CHANGED!     @")
+	_, _ = fmt.Fprintln(os.Stderr, banner)
+	_, _ = fmt.Fprintln(os.Stderr, "IT IS POSSIBLE THAT SOMEONE IS DOING SOMETHING NASTY!")
+	_, _ = fmt.Fprintln(os.Stderr, "Someone could be eavesdropping on you right now (man-in-the-middle attack)!")
+	_, _ = fmt.Fprintln(os.Stderr, "It is also possible that a host key has just been changed.")
+	_, _ = fmt.Fprintf(os.Stderr, "The fingerprint for the %s key sent by %s is\n%s.\n", keyTypeName(key), name, ssh.FingerprintSHA256(key))
+	_, _ = fmt.Fprintln(os.Stderr, RandomArt(key))
+	for _, want := range keyErr.Want {
+		_, _ = fmt.Fprintf(os.Stderr, "Offending %s key in %s:%d\n", keyTypeName(want.Key), want.Filename, want.Line)
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "If the change is expected, remove the old key with: zssh known-hosts remove %s\n", name)
+
+	if k.strictHostKeyChecking() == StrictHostKeyCheckingNo {
+		log.Warnf("strict host key checking is disabled, connecting to %s anyway", name)
+		return nil
+	}
+	return fmt.Errorf("host key verification failed: the host key for %s has changed", name)
+}
+
+func ensureKnownHosts(filePath string) error {
+	_, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		// Create the directories if they don't exist
+		dir := filepath.Dir(filePath)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("failed to create directories: %w", err)
+		}
+
+		// Create the file with 0600 permissions
+		file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to create file: %w", err)
+		}
+		defer file.Close()
+	} else if err != nil {
+		return fmt.Errorf("error checking file: %w", err)
+	}
+
+	return nil
+}
+
+func knownHostsFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Fatalf("unable to determine home directory - cannot find known_hosts file: %v", err)
+	}
+	return path.Join(home, ".ssh", "known_hosts")
+}
+
+// Add appends an entry for hostname to the known_hosts file, hashing the host name when k.Hash is set
+func (k *KnownHosts) Add(hostname string, key ssh.PublicKey) error {
+	if err := ensureKnownHosts(k.file()); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(k.file(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	// the lookup side hashes the normalized form, so the entry must be hashed the same way
+	host := knownHostEntryName(hostname)
+	if k.Hash {
+		host = knownhosts.HashHostname(knownhosts.Normalize(hostname))
+	}
+	entry := fmt.Sprintf("%s %s\n", host, keyToString(key))
+
+	if _, err := f.WriteString(entry); err != nil {
+		return fmt.Errorf("failed to write to known_hosts file: %v", err)
+	}
+
+	return err
+}
+
+// Entries returns every host key entry in the known_hosts file
+func (k *KnownHosts) Entries() ([]KnownHostEntry, error) {
+	content, err := os.ReadFile(k.file())
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []KnownHostEntry
+	for i, line := range strings.Split(string(content), "\n") {
+		entry, ok := parseKnownHostLine(line)
+		if !ok {
+			continue
+		}
+		entry.Line = i + 1
+		entries = append(entries, *entry)
+	}
+	return entries, nil
+}
+
+// Lookup returns the entries whose host patterns match host, including hashed entries
+func (k *KnownHosts) Lookup(host string) ([]KnownHostEntry, error) {
+	entries, err := k.Entries()
+	if err != nil {
+		return nil, err
+	}
+	var matches []KnownHostEntry
+	for _, entry := range entries {
+		if entry.Matches(host) {
+			matches = append(matches, entry)
+		}
+	}
+	return matches, nil
+}
+
+// Remove deletes every entry matching host, like ssh-keygen -R. The original file is kept as known_hosts.old.
+// It returns the removed entries.
+func (k *KnownHosts) Remove(host string) ([]KnownHostEntry, error) {
+	content, err := os.ReadFile(k.file())
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []KnownHostEntry
+	var kept bytes.Buffer
+	lines := strings.Split(string(content), "\n")
+	for i, line := range lines {
+		if entry, ok := parseKnownHostLine(line); ok && entry.Matches(host) {
+			entry.Line = i + 1
+			removed = append(removed, *entry)
+			continue
+		}
+		kept.WriteString(line)
+		if i < len(lines)-1 {
+			kept.WriteString("\n")
+		}
+	}
+
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	if err := os.WriteFile(k.file()+".old", content, 0600); err != nil {
+		return nil, fmt.Errorf("failed to back up known_hosts file: %w", err)
+	}
+	if err := os.WriteFile(k.file(), kept.Bytes(), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write known_hosts file: %w", err)
+	}
+	return removed, nil
+}
+
+func parseKnownHostLine(line string) (*KnownHostEntry, bool) {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return nil, false
+	}
+	marker, hosts, key, comment, _, err := ssh.ParseKnownHosts([]byte(trimmed))
+	if err != nil {
+		return nil, false
+	}
+	return &KnownHostEntry{
+		Marker:  marker,
+		Hosts:   hosts,
+		Key:     key,
+		Comment: comment,
+	}, true
+}
+
+// Matches reports whether host matches one of the entry's host patterns. Plain patterns may use the * and ?
+// wildcards, negated patterns (!pattern) exclude the host. [host]:port patterns are compared in normalized form.
+func (e *KnownHostEntry) Matches(host string) bool {
+	host = knownhosts.Normalize(host)
+	matched := false
+	for _, pattern := range e.Hosts {
+		if strings.HasPrefix(pattern, hashedHostPrefix) {
+			if hashedHostMatches(pattern, host) {
+				matched = true
+			}
+			continue
+		}
+		negate := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		if strings.HasPrefix(pattern, "[") {
+			pattern = knownhosts.Normalize(pattern)
+		}
+		if wildcardMatch(pattern, host) {
+			if negate {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// wildcardMatch matches s against an OpenSSH host pattern, where * matches any run of characters and ? matches
+// exactly one. Unlike path.Match, brackets are literal so [host]:port entries match as written.
+func wildcardMatch(pattern string, s string) bool {
+	if pattern == "" {
+		return s == ""
+	}
+	switch pattern[0] {
+	case '*':
+		for i := 0; i <= len(s); i++ {
+			if wildcardMatch(pattern[1:], s[i:]) {
+				return true
+			}
+		}
+		return false
+	case '?':
+		return s != "" && wildcardMatch(pattern[1:], s[1:])
+	default:
+		return s != "" && pattern[0] == s[0] && wildcardMatch(pattern[1:], s[1:])
+	}
+}
+
+// hashedHostMatches checks host against a |1|base64(salt)|base64(hmac-sha1(salt, host)) pattern
+func hashedHostMatches(pattern string, host string) bool {
+	parts := strings.Split(strings.TrimPrefix(pattern, hashedHostPrefix), "|")
+	if len(parts) != 2 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	want, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+// DisplayHosts returns the entry's host patterns for display. Hashed names cannot be reversed and are shown as-is.
+func (e *KnownHostEntry) DisplayHosts() string {
+	hosts := strings.Join(e.Hosts, ",")
+	if e.Marker != "" {
+		return "@" + e.Marker + " " + hosts
+	}
+	return hosts
+}
+
+func NewKnownHostsCmd() *cobra.Command {
+	knownHosts := &KnownHosts{}
+	cmd := &cobra.Command{
+		Use:   "known-hosts",
+		Short: "Manage the host keys in the known_hosts file",
+	}
+	cmd.PersistentFlags().StringVarP(&knownHosts.File, "file", "f", "", "known_hosts file. default: ~/.ssh/known_hosts")
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the entries of the known_hosts file with their SHA256 fingerprints",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			entries, err := knownHosts.Entries()
+			if err != nil {
+				log.Fatalf("unable to read known_hosts file: %v", err)
+			}
+			for _, entry := range entries {
+				fmt.Printf("%d: %s %s %s\n", entry.Line, entry.DisplayHosts(), entry.Key.Type(), ssh.FingerprintSHA256(entry.Key))
+			}
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:     "remove <host>",
+		Example: "  zssh known-hosts remove [zssh:myhost]",
+		Short:   "Remove all keys belonging to host from the known_hosts file, like ssh-keygen -R",
+		Args:    cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			removed, err := knownHosts.Remove(args[0])
+			if err != nil {
+				log.Fatalf("unable to remove %s from known_hosts file: %v", args[0], err)
+			}
+			if len(removed) == 0 {
+				log.Fatalf("host %s not found in %s", args[0], knownHosts.file())
+			}
+			for _, entry := range removed {
+				fmt.Printf("removed line %d: %s %s\n", entry.Line, entry.Key.Type(), ssh.FingerprintSHA256(entry.Key))
+			}
+			fmt.Printf("%s updated, original contents retained as %s.old\n", knownHosts.file(), knownHosts.file())
+		},
+	})
+
+	var visual bool
+	fingerprintCmd := &cobra.Command{
+		Use:   "fingerprint <host>",
+		Short: "Show the SHA256 fingerprints of the keys known for host, like ssh-keygen -F",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			entries, err := knownHosts.Lookup(args[0])
+			if err != nil {
+				log.Fatalf("unable to read known_hosts file: %v", err)
+			}
+			if len(entries) == 0 {
+				log.Fatalf("host %s not found in %s", args[0], knownHosts.file())
+			}
+			for _, entry := range entries {
+				fmt.Printf("%d: %s %s %s\n", entry.Line, args[0], entry.Key.Type(), ssh.FingerprintSHA256(entry.Key))
+				if visual {
+					fmt.Println(RandomArt(entry.Key))
+				}
+			}
+		},
+	}
+	fingerprintCmd.Flags().BoolVarP(&visual, "visual", "v", false, "also show the visual host key")
+	cmd.AddCommand(fingerprintCmd)
+	return cmd
+}
@@ -0,0 +1,217 @@
+package zsshlib
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestKnownHostsHashed(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	key, _ := ssh.NewPublicKey(pub)
+	k := &KnownHosts{File: filepath.Join(t.TempDir(), "known_hosts"), Hash: true}
+
+	assert.NoError(t, k.Add("router.example.com:8442", key))
+	content, _ := os.ReadFile(k.File)
+	assert.True(t, strings.HasPrefix(string(content), hashedHostPrefix), "entry not hashed")
+	assert.False(t, strings.Contains(string(content), "router.example.com"), "host name leaked")
+
+	// the hashed entry must be accepted by the knownhosts callback used to verify connections
+	cb, err := knownhosts.New(k.File)
+	assert.NoError(t, err)
+	assert.NoError(t, cb("router.example.com:8442", zitiEdgeConnAdapter{orig: fakeAddr("x:router.example.com:8442")}, key))
+
+	matches, err := k.Lookup("router.example.com:8442")
+	assert.NoError(t, err)
+	assert.Equal(t, len(matches), 1, "hashed entry not found")
+
+	removed, err := k.Remove("router.example.com:8442")
+	assert.NoError(t, err)
+	assert.Equal(t, len(removed), 1, "hashed entry not removed")
+	entries, err := k.Entries()
+	assert.NoError(t, err)
+	assert.Equal(t, len(entries), 0, "entries remain after remove")
+	_, err = os.Stat(k.File + ".old")
+	assert.NoError(t, err, "backup not written")
+}
+
+func TestKnownHostEntryMatches(t *testing.T) {
+	e := &KnownHostEntry{Hosts: []string{"*.example.com", "!bad.example.com", "[10.0.0.1]:8442"}}
+	assert.True(t, e.Matches("good.example.com"))
+	assert.False(t, e.Matches("bad.example.com"))
+	assert.True(t, e.Matches("10.0.0.1:8442"))
+	assert.False(t, e.Matches("1:8442"))
+	assert.False(t, e.Matches("example.org"))
+}
+
+type fakeAddr string
+
+func (a fakeAddr) Network() string { return "tcp" }
+func (a fakeAddr) String() string  { return string(a) }
+
+func TestKnownHostsAliasMigration(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	key, _ := ssh.NewPublicKey(pub)
+	remote := fakeAddr("ziti-edge-router connId=1, logical=ziti-sdk[router=tls:router.example.com:8442]")
+	file := filepath.Join(t.TempDir(), "known_hosts")
+
+	legacy := &KnownHosts{File: file}
+	assert.NoError(t, legacy.Add("router.example.com:8442", key))
+
+	for _, hash := range []bool{false, true} {
+		k := &KnownHosts{File: file, Alias: KnownHostsAlias("zssh", "myhost"), Hash: hash}
+		assert.NoError(t, k.HostKeyCallback("", remote, key), "router entry not migrated")
+
+		matches, err := k.Lookup("[zssh:myhost]")
+		assert.NoError(t, err)
+		assert.Equal(t, len(matches), 1, "key not recorded under the identity")
+
+		// the migrated entry is used directly from now on
+		assert.NoError(t, k.HostKeyCallback("", fakeAddr("tls:other-router.example.com:8442"), key))
+		_, err = k.Remove("[zssh:myhost]")
+		assert.NoError(t, err)
+	}
+}
+
+func TestStrictHostKeyChecking(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	key, _ := ssh.NewPublicKey(pub)
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _ := ssh.NewPublicKey(otherPub)
+	remote := fakeAddr("tls:router.example.com:8442")
+	alias := KnownHostsAlias("zssh", "myhost")
+
+	k := &KnownHosts{File: filepath.Join(t.TempDir(), "known_hosts"), Alias: alias, StrictHostKeyChecking: StrictHostKeyCheckingYes}
+	assert.Error(t, k.HostKeyCallback("", remote, key), "unknown key accepted")
+	entries, _ := k.Entries()
+	assert.Equal(t, len(entries), 0, "unknown key added")
+
+	k.StrictHostKeyChecking = StrictHostKeyCheckingAcceptNew
+	assert.NoError(t, k.HostKeyCallback("", remote, key), "new key not accepted")
+	entries, _ = k.Entries()
+	assert.Equal(t, len(entries), 1, "new key not added")
+	assert.Error(t, k.HostKeyCallback("", remote, otherKey), "changed key accepted")
+
+	k.StrictHostKeyChecking = StrictHostKeyCheckingNo
+	assert.NoError(t, k.HostKeyCallback("", remote, otherKey), "changed key refused")
+	entries, _ = k.Entries()
+	assert.Equal(t, len(entries), 1, "changed key added")
+
+	k.StrictHostKeyChecking = "maybe"
+	k.Alias = KnownHostsAlias("zssh", "otherhost")
+	assert.Error(t, k.HostKeyCallback("", remote, key), "invalid mode accepted")
+}
+
+func TestCheckStrictHostKeyChecking(t *testing.T) {
+	for _, mode := range StrictHostKeyCheckingModes {
+		assert.NoError(t, CheckStrictHostKeyChecking(mode), mode+" refused")
+	}
+	err := CheckStrictHostKeyChecking("accept_new")
+	assert.ErrorContains(t, err, "yes, no, accept-new, ask", "valid modes not listed")
+}
+
+func TestRandomArt(t *testing.T) {
+	// expected output from ssh-keygen -lvf
+	key, _, _, _, _ := ssh.ParseAuthorizedKey([]byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOCZ9MzHHhQwlZyZiUBlPOlG0Jdyo/H/QSdB9eT/50Hy"))
+	expected := `+--[ED25519 256]--+
+|   .  .o+o       |
+|  o o .ooo    .  |
+| . o o. +    E  o|
+|  .   o+    . ..B|
+|     o  S+   +o*o|
+|      . * o ..=o+|
+|       o =.....=+|
+|        o.o= .. o|
+|        .=*..    |
++----[SHA256]-----+`
+	assert.Equal(t, RandomArt(key), expected, "random art not correct")
+}
+
+func newHostCertificate(t *testing.T, ca ssh.Signer, principal string, serial uint64) *ssh.Certificate {
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	key, _ := ssh.NewPublicKey(pub)
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          serial,
+		CertType:        ssh.HostCert,
+		KeyId:           principal,
+		ValidPrincipals: []string{principal},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	assert.NoError(t, cert.SignCert(rand.Reader, ca))
+	return cert
+}
+
+func TestHostCertificate(t *testing.T) {
+	_, caKey, _ := ed25519.GenerateKey(rand.Reader)
+	ca, _ := ssh.NewSignerFromKey(caKey)
+	remote := fakeAddr("tls:router.example.com:8442")
+	dir := t.TempDir()
+	file := filepath.Join(dir, "known_hosts")
+	assert.NoError(t, os.WriteFile(file, []byte("@cert-authority zssh:* "+keyToString(ca.PublicKey())+"\n"), 0600))
+
+	k := &KnownHosts{File: file, Alias: KnownHostsAlias("zssh", "myhost"), Principal: "myhost", StrictHostKeyChecking: StrictHostKeyCheckingYes}
+	assert.NoError(t, k.HostKeyCallback("", remote, newHostCertificate(t, ca, "myhost", 1)), "certificate not accepted")
+	assert.Error(t, k.HostKeyCallback("", remote, newHostCertificate(t, ca, "otherhost", 2)), "wrong principal accepted")
+
+	// an untrusted CA falls back to the plain key, which is unknown
+	_, otherCaKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherCa, _ := ssh.NewSignerFromKey(otherCaKey)
+	assert.Error(t, k.HostKeyCallback("", remote, newHostCertificate(t, otherCa, "myhost", 3)), "untrusted CA accepted")
+
+	// host_ca_keys trusts a CA without a known_hosts entry
+	caFile := filepath.Join(dir, "host_ca.pub")
+	assert.NoError(t, os.WriteFile(caFile, []byte(keyToString(otherCa.PublicKey())+"\n"), 0600))
+	k.HostCAKeys = []string{caFile}
+	assert.NoError(t, k.HostKeyCallback("", remote, newHostCertificate(t, otherCa, "myhost", 4)), "host_ca_keys not trusted")
+
+	revokedCert := newHostCertificate(t, ca, "myhost", 5)
+	k.RevokedHostKeys = filepath.Join(dir, "revoked_keys")
+	assert.NoError(t, os.WriteFile(k.RevokedHostKeys, []byte(keyToString(revokedCert.Key)+"\n"), 0600))
+	assert.Error(t, k.HostKeyCallback("", remote, revokedCert), "revoked key accepted")
+
+	k.RevokedHostKeys = ""
+	f, _ := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+	_, _ = f.WriteString("@revoked * " + keyToString(ca.PublicKey()) + "\n")
+	_ = f.Close()
+	assert.Error(t, k.HostKeyCallback("", remote, newHostCertificate(t, ca, "myhost", 6)), "revoked CA accepted")
+}
+
+func TestRevocationListKRL(t *testing.T) {
+	_, caKey, _ := ed25519.GenerateKey(rand.Reader)
+	ca, _ := ssh.NewSignerFromKey(caKey)
+
+	// a KRL revoking serials 10-20 and key id "lost" of ca
+	u64 := func(v uint64) []byte { return ssh.Marshal(struct{ V uint64 }{v}) }
+	str := func(b []byte) []byte { return ssh.Marshal(struct{ S []byte }{b}) }
+	serials := append(u64(10), u64(20)...)
+	certSection := append(str(ca.PublicKey().Marshal()), str(nil)...)
+	certSection = append(certSection, krlCertSerialRange)
+	certSection = append(certSection, str(serials)...)
+	certSection = append(certSection, krlCertKeyId)
+	certSection = append(certSection, str(str([]byte("lost")))...)
+	krl := append([]byte(krlMagic), ssh.Marshal(struct{ V uint32 }{1})...)
+	krl = append(krl, u64(1)...)
+	krl = append(krl, u64(0)...)
+	krl = append(krl, u64(0)...)
+	krl = append(krl, str(nil)...)
+	krl = append(krl, str(nil)...)
+	krl = append(krl, krlSectionCertificates)
+	krl = append(krl, str(certSection)...)
+
+	file := filepath.Join(t.TempDir(), "revoked.krl")
+	assert.NoError(t, os.WriteFile(file, krl, 0600))
+	rl, err := loadRevocationList(file)
+	assert.NoError(t, err)
+
+	assert.True(t, rl.certRevoked(newHostCertificate(t, ca, "myhost", 15)), "serial in range not revoked")
+	assert.False(t, rl.certRevoked(newHostCertificate(t, ca, "myhost", 21)), "serial out of range revoked")
+	assert.True(t, rl.certRevoked(newHostCertificate(t, ca, "lost", 30)), "key id not revoked")
+}
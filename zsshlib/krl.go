@@ -0,0 +1,267 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// OpenSSH key revocation list format, see PROTOCOL.krl in the OpenSSH sources
+const (
+	krlMagic = "SSHKRL\n\x00"
+
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSha1   = 3
+	krlSectionSignature         = 4
+	krlSectionFingerprintSha256 = 5
+
+	krlCertSerialList   = 0x20
+	krlCertSerialRange  = 0x21
+	krlCertSerialBitmap = 0x22
+	krlCertKeyId        = 0x23
+)
+
+// revocationList holds the keys and certificates revoked by a KRL, or by a plain list of public keys as accepted
+// by OpenSSH's RevokedHostKeys
+type revocationList struct {
+	keys   map[string]bool
+	sha1   map[string]bool
+	sha256 map[string]bool
+	certs  []krlCertificates
+}
+
+// krlCertificates are the certificates revoked for one CA. An empty caKey applies to certificates from any CA.
+type krlCertificates struct {
+	caKey   []byte
+	ranges  [][2]uint64
+	bitmaps []krlSerialBitmap
+	keyIds  map[string]bool
+}
+
+type krlSerialBitmap struct {
+	offset uint64
+	bits   *big.Int
+}
+
+func newRevocationList() *revocationList {
+	return &revocationList{
+		keys:   map[string]bool{},
+		sha1:   map[string]bool{},
+		sha256: map[string]bool{},
+	}
+}
+
+// loadRevocationList reads an OpenSSH KRL, or a file of public keys one per line
+func loadRevocationList(file string) (*revocationList, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(content, []byte(krlMagic)) {
+		rl, err := parseKRL(content)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KRL [%s]: %w", file, err)
+		}
+		return rl, nil
+	}
+
+	rl := newRevocationList()
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("invalid revoked key in [%s]: %w", file, err)
+		}
+		rl.keys[string(key.Marshal())] = true
+	}
+	return rl, nil
+}
+
+// krlReader reads the ssh wire encoding used by KRLs
+type krlReader struct {
+	data []byte
+	err  error
+}
+
+func (r *krlReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < n {
+		r.err = fmt.Errorf("truncated data")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *krlReader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *krlReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *krlReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *krlReader) string() []byte {
+	return r.next(int(r.uint32()))
+}
+
+func (r *krlReader) more() bool {
+	return r.err == nil && len(r.data) > 0
+}
+
+func parseKRL(content []byte) (*revocationList, error) {
+	r := &krlReader{data: content}
+	r.next(len(krlMagic))
+	if version := r.uint32(); r.err == nil && version != 1 {
+		return nil, fmt.Errorf("unsupported format version %d", version)
+	}
+	r.uint64() // krl_version
+	r.uint64() // generated_date
+	r.uint64() // flags
+	r.string() // reserved
+	r.string() // comment
+
+	rl := newRevocationList()
+	for r.more() {
+		sectionType := r.byte()
+		section := &krlReader{data: r.string()}
+		switch sectionType {
+		case krlSectionCertificates:
+			rl.certs = append(rl.certs, parseKRLCertificates(section))
+		case krlSectionExplicitKey:
+			for section.more() {
+				rl.keys[string(section.string())] = true
+			}
+		case krlSectionFingerprintSha1:
+			for section.more() {
+				rl.sha1[string(section.string())] = true
+			}
+		case krlSectionFingerprintSha256:
+			for section.more() {
+				rl.sha256[string(section.string())] = true
+			}
+		case krlSectionSignature:
+			// KRL signatures are not verified, the file is trusted like known_hosts is
+		default:
+			return nil, fmt.Errorf("unsupported section type %d", sectionType)
+		}
+		if section.err != nil {
+			return nil, fmt.Errorf("section type %d: %w", sectionType, section.err)
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return rl, nil
+}
+
+func parseKRLCertificates(r *krlReader) krlCertificates {
+	certs := krlCertificates{keyIds: map[string]bool{}}
+	certs.caKey = r.string()
+	r.string() // reserved
+	for r.more() {
+		subsectionType := r.byte()
+		subsection := &krlReader{data: r.string()}
+		switch subsectionType {
+		case krlCertSerialList:
+			for subsection.more() {
+				serial := subsection.uint64()
+				certs.ranges = append(certs.ranges, [2]uint64{serial, serial})
+			}
+		case krlCertSerialRange:
+			certs.ranges = append(certs.ranges, [2]uint64{subsection.uint64(), subsection.uint64()})
+		case krlCertSerialBitmap:
+			offset := subsection.uint64()
+			certs.bitmaps = append(certs.bitmaps, krlSerialBitmap{offset: offset, bits: new(big.Int).SetBytes(subsection.string())})
+		case krlCertKeyId:
+			for subsection.more() {
+				certs.keyIds[string(subsection.string())] = true
+			}
+		default:
+			r.err = fmt.Errorf("unsupported certificate section type %d", subsectionType)
+		}
+		if subsection.err != nil {
+			r.err = subsection.err
+		}
+	}
+	return certs
+}
+
+// keyRevoked reports whether the plain key is revoked
+func (rl *revocationList) keyRevoked(key ssh.PublicKey) bool {
+	blob := key.Marshal()
+	sha1Sum := sha1.Sum(blob)
+	sha256Sum := sha256.Sum256(blob)
+	return rl.keys[string(blob)] || rl.sha1[string(sha1Sum[:])] || rl.sha256[string(sha256Sum[:])]
+}
+
+// certRevoked reports whether the certificate, by serial or key id, or the key it certifies is revoked
+func (rl *revocationList) certRevoked(cert *ssh.Certificate) bool {
+	if rl.keyRevoked(cert.Key) {
+		return true
+	}
+	ca := cert.SignatureKey.Marshal()
+	for _, certs := range rl.certs {
+		if len(certs.caKey) > 0 && !bytes.Equal(certs.caKey, ca) {
+			continue
+		}
+		if certs.keyIds[cert.KeyId] {
+			return true
+		}
+		for _, serials := range certs.ranges {
+			if cert.Serial >= serials[0] && cert.Serial <= serials[1] {
+				return true
+			}
+		}
+		for _, bitmap := range certs.bitmaps {
+			if cert.Serial >= bitmap.offset && cert.Serial-bitmap.offset < uint64(bitmap.bits.BitLen()) &&
+				bitmap.bits.Bit(int(cert.Serial-bitmap.offset)) == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
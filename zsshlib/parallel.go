@@ -0,0 +1,95 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Transfer is one file transfer of a multi-file copy
+type Transfer struct {
+	// Name identifies the transfer in errors
+	Name string
+	Run  func() error
+}
+
+// RunTransfers runs the transfers, up to workers at a time. A sftp client may be shared by the transfers, its
+// requests are multiplexed over the session. done, which may be nil, is called for every transfer in the order
+// of transfers, not the order they finish in, so logging stays readable. Failed transfers do not stop the others,
+// their errors are returned together.
+func RunTransfers(workers int, transfers []Transfer, done func(t Transfer, err error)) error {
+	if workers < 1 {
+		workers = 1
+	}
+	results := make([]error, len(transfers))
+	finished := make([]bool, len(transfers))
+	next := 0
+	var mu sync.Mutex
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(workers, len(transfers)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				err := transfers[i].Run()
+
+				mu.Lock()
+				results[i], finished[i] = err, true
+				for ; next < len(transfers) && finished[next]; next++ {
+					if done != nil {
+						done(transfers[next], results[next])
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range transfers {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	var errs []error
+	for i, err := range results {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", transfers[i].Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// LogTransfers returns a done function for RunTransfers logging every successful transfer at info level as
+// "<verb> file: <name>", followed by its SHA-256 when checksums, which may be nil, holds one under its name
+func LogTransfers(verb string, checksums *sync.Map) func(t Transfer, err error) {
+	return func(t Transfer, err error) {
+		if err != nil {
+			return
+		}
+		log.Infof("%s file: %s", verb, t.Name)
+		if checksums == nil {
+			return
+		}
+		if sum, ok := checksums.Load(t.Name); ok {
+			log.Infof("verified %s: sha256 %x", t.Name, sum)
+		}
+	}
+}
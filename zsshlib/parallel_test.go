@@ -0,0 +1,82 @@
+package zsshlib
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunTransfers(t *testing.T) {
+	var running, maxRunning int32
+	var transfers []Transfer
+	for i := 0; i < 20; i++ {
+		transfers = append(transfers, Transfer{Name: fmt.Sprintf("file%02d", i), Run: func() error {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+			// later files finish first
+			time.Sleep(time.Duration(20-i) * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			if i%7 == 3 {
+				return fmt.Errorf("failed")
+			}
+			return nil
+		}})
+	}
+
+	var order []string
+	err := RunTransfers(4, transfers, func(t Transfer, err error) { order = append(order, t.Name) })
+	assert.Equal(t, int(maxRunning), 4, "transfers not run concurrently")
+	assert.Equal(t, len(order), 20, "not every transfer reported")
+	for i, name := range order {
+		assert.Equal(t, name, fmt.Sprintf("file%02d", i), "transfers not reported in order")
+	}
+	assert.Error(t, err, "errors not returned")
+	assert.Equal(t, strings.Count(err.Error(), "failed"), 3, "errors not aggregated")
+	assert.True(t, strings.Contains(err.Error(), "file10: failed"), "error does not name the file")
+
+	assert.NoError(t, RunTransfers(0, transfers[:1], nil), "single transfer failed")
+}
+
+func TestLogTransfers(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	var checksums sync.Map
+	checksums.Store("file1", []byte{0xab})
+
+	var transfers []Transfer
+	for i := 0; i < 5; i++ {
+		transfers = append(transfers, Transfer{Name: fmt.Sprintf("file%d", i), Run: func() error {
+			// later files finish first
+			time.Sleep(time.Duration(5-i) * 10 * time.Millisecond)
+			if i == 3 {
+				return fmt.Errorf("failed")
+			}
+			return nil
+		}})
+	}
+	assert.Error(t, RunTransfers(5, transfers, LogTransfers("copied", &checksums)))
+
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		assert.Contains(t, line, "INFO", "not logged at info level")
+		lines = append(lines, line[strings.Index(line, "INFO")+len("INFO"):])
+	}
+	want := []string{"copied file: file0", "copied file: file1", "verified file1: sha256 ab", "copied file: file2", "copied file: file4"}
+	assert.Equal(t, len(lines), len(want), "wrong number of lines logged")
+	for i := range min(len(lines), len(want)) {
+		assert.Contains(t, lines[i], want[i], "transfers not logged in order")
+	}
+}
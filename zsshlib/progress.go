@@ -0,0 +1,283 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const progressRedrawInterval = 100 * time.Millisecond
+
+// TransferProgress reports how far the transfer of one file is
+type TransferProgress struct {
+	// Name is the file being transferred, as it should be displayed
+	Name        string
+	Transferred int64
+	Total       int64
+	// Offset is how much of the file was already at the destination when a resumed transfer started
+	Offset int64
+	// Done is set on the last report for the file, whether or not the transfer succeeded
+	Done bool
+	// Failed is set with Done when the transfer did not succeed
+	Failed bool
+}
+
+// ProgressFunc is called as a file transfer progresses. It may be nil.
+type ProgressFunc func(p TransferProgress)
+
+// progressReader reports the bytes read through it. Size lets the sftp client size its concurrent writes
+// as it would for the underlying file.
+type progressReader struct {
+	r           io.Reader
+	name        string
+	offset      int64
+	total       int64
+	transferred int64
+	progress    ProgressFunc
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.transferred += int64(n)
+	p.progress(p.report(false))
+	return n, err
+}
+
+// Size returns the bytes left to read
+func (p *progressReader) Size() int64 {
+	return p.total - p.transferred
+}
+
+func (p *progressReader) report(done bool) TransferProgress {
+	return TransferProgress{Name: p.name, Transferred: p.transferred, Total: p.total, Offset: p.offset, Done: done}
+}
+
+// finish returns the last report, for a transfer that ended with err
+func (p *progressReader) finish(err error) TransferProgress {
+	last := p.report(true)
+	last.Failed = err != nil
+	return last
+}
+
+// progressWriter reports the bytes written through it
+type progressWriter struct {
+	w           io.Writer
+	name        string
+	offset      int64
+	total       int64
+	transferred int64
+	progress    ProgressFunc
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.transferred += int64(n)
+	p.progress(p.report(false))
+	return n, err
+}
+
+func (p *progressWriter) report(done bool) TransferProgress {
+	return TransferProgress{Name: p.name, Transferred: p.transferred, Total: p.total, Offset: p.offset, Done: done}
+}
+
+// finish returns the last report, for a transfer that ended with err
+func (p *progressWriter) finish(err error) TransferProgress {
+	last := p.report(true)
+	last.Failed = err != nil
+	return last
+}
+
+// ProgressBar draws a progress bar per file on a terminal and totals up the run for Summary. Files may be
+// transferred concurrently, while more than one is in flight the bar shows their combined progress.
+type ProgressBar struct {
+	out     io.Writer
+	enabled bool
+	width   int
+
+	mu       sync.Mutex
+	active   map[string]*activeTransfer
+	lastDraw time.Time
+	runStart time.Time
+	files    int
+	bytes    int64
+}
+
+// activeTransfer is the last reported progress of a file still in flight
+type activeTransfer struct {
+	start time.Time
+	last  TransferProgress
+}
+
+// NewProgressBar returns a ProgressBar drawing on out, which is width columns wide. When enabled is false
+// nothing is drawn, which is what callers want when out is not a terminal.
+func NewProgressBar(out io.Writer, enabled bool, width int) *ProgressBar {
+	if width <= 0 {
+		width = 80
+	}
+	return &ProgressBar{
+		out:      out,
+		enabled:  enabled,
+		width:    width,
+		active:   map[string]*activeTransfer{},
+		runStart: time.Now(),
+	}
+}
+
+// Update is a ProgressFunc. It is safe for concurrent use.
+func (b *ProgressBar) Update(p TransferProgress) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	transfer, ok := b.active[p.Name]
+	if !ok {
+		transfer = &activeTransfer{start: now}
+		b.active[p.Name] = transfer
+		b.lastDraw = time.Time{}
+	}
+	transfer.last = p
+	if p.Done {
+		// the summary counts the files that arrived, not the ones that failed part way
+		if !p.Failed {
+			b.files++
+			b.bytes += p.Transferred - p.Offset
+		}
+		delete(b.active, p.Name)
+	}
+	if !b.enabled {
+		return
+	}
+	if !p.Done && now.Sub(b.lastDraw) < progressRedrawInterval {
+		return
+	}
+	b.lastDraw = now
+
+	if p.Done {
+		// finished files keep their line, the bar of the others is redrawn below it
+		_, _ = fmt.Fprintf(b.out, "\r%s\n", b.render(p, now.Sub(transfer.start)))
+		return
+	}
+	if len(b.active) == 1 {
+		_, _ = fmt.Fprintf(b.out, "\r%s", b.render(p, now.Sub(transfer.start)))
+		return
+	}
+	combined := TransferProgress{Name: fmt.Sprintf("%d files", len(b.active))}
+	start := now
+	for _, t := range b.active {
+		combined.Transferred += t.last.Transferred
+		combined.Total += t.last.Total
+		combined.Offset += t.last.Offset
+		if t.start.Before(start) {
+			start = t.start
+		}
+	}
+	_, _ = fmt.Fprintf(b.out, "\r%s", b.render(combined, now.Sub(start)))
+}
+
+// render returns the progress line for p: name, bar, percent, bytes, rate and ETA or elapsed time
+func (b *ProgressBar) render(p TransferProgress, elapsed time.Duration) string {
+	percent := 100
+	if p.Total > 0 {
+		percent = int(min(p.Transferred*100/p.Total, 100))
+	}
+	rate := float64(0)
+	if elapsed > 0 {
+		rate = float64(p.Transferred-p.Offset) / elapsed.Seconds()
+	}
+	eta := "--:--"
+	if p.Done {
+		eta = formatDuration(elapsed) + "   "
+	} else if rate > 0 && p.Total >= p.Transferred {
+		eta = formatDuration(time.Duration(float64(p.Total-p.Transferred)/rate*float64(time.Second))) + " ETA"
+	}
+	stats := fmt.Sprintf(" %3d%% %9s %9s/s %s", percent, FormatBytes(p.Transferred), FormatBytes(int64(rate)), eta)
+
+	// the rest of the line is split between the name and the bar
+	space := b.width - len(stats) - 1
+	barWidth := 0
+	if space > 30 {
+		barWidth = space / 3
+		space -= barWidth + 3
+	}
+	name := p.Name
+	if space < 1 {
+		space = 1
+	}
+	if len(name) > space {
+		if space > 3 {
+			name = "..." + name[len(name)-space+3:]
+		} else {
+			name = name[len(name)-space:]
+		}
+	}
+	line := fmt.Sprintf("%-*s", space, name)
+	if barWidth > 0 {
+		filled := barWidth * percent / 100
+		line += " [" + strings.Repeat("=", filled) + strings.Repeat(" ", barWidth-filled) + "]"
+	}
+	return line + stats
+}
+
+// Summary returns the totals of the run: files, bytes, elapsed time and average throughput
+func (b *ProgressBar) Summary() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	elapsed := time.Since(b.runStart)
+	rate := float64(0)
+	if elapsed > 0 {
+		rate = float64(b.bytes) / elapsed.Seconds()
+	}
+	files := "files"
+	if b.files == 1 {
+		files = "file"
+	}
+	return fmt.Sprintf("%d %s, %s in %s (%s/s)", b.files, files, FormatBytes(b.bytes), formatDuration(elapsed), FormatBytes(int64(rate)))
+}
+
+// PrintSummary writes Summary to the output, if the progress bar is enabled
+func (b *ProgressBar) PrintSummary() {
+	if b.enabled {
+		_, _ = fmt.Fprintln(b.out, b.Summary())
+	}
+}
+
+// FormatBytes returns n in human readable binary units, e.g. 1.5 MiB
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// formatDuration returns d as mm:ss, or hh:mm:ss from an hour on
+func formatDuration(d time.Duration) string {
+	s := int64(d.Round(time.Second) / time.Second)
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s%3600/60, s%60)
+	}
+	return fmt.Sprintf("%02d:%02d", s/60, s%60)
+}
@@ -0,0 +1,65 @@
+package zsshlib
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, FormatBytes(512), "512 B", "bytes not correct")
+	assert.Equal(t, FormatBytes(1536), "1.5 KiB", "KiB not correct")
+	assert.Equal(t, FormatBytes(20<<30), "20.0 GiB", "GiB not correct")
+}
+
+func TestProgressBar(t *testing.T) {
+	var out bytes.Buffer
+	bar := NewProgressBar(&out, true, 80)
+	bar.Update(TransferProgress{Name: "a.bin", Transferred: 512, Total: 1024})
+	bar.Update(TransferProgress{Name: "a.bin", Transferred: 1024, Total: 1024, Done: true})
+	bar.Update(TransferProgress{Name: "b.bin", Transferred: 1024, Total: 1024, Done: true})
+	bar.Update(TransferProgress{Name: "c.bin", Transferred: 1024, Total: 4096, Done: true, Failed: true})
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	assert.Equal(t, len(lines), 3, "one line per file expected")
+	assert.True(t, strings.Contains(lines[0], " 50%"), "progress percent missing")
+	assert.True(t, strings.Contains(lines[0], "100%"), "final percent missing")
+	for _, line := range lines {
+		parts := strings.Split(line, "\r")
+		assert.Equal(t, len(parts[len(parts)-1]), 79, "line width not correct")
+	}
+	assert.True(t, strings.HasPrefix(bar.Summary(), "2 files, 2.0 KiB in "), "summary not correct, failed files are not counted")
+
+	out.Reset()
+	quiet := NewProgressBar(&out, false, 80)
+	quiet.Update(TransferProgress{Name: "a.bin", Transferred: 1024, Total: 1024, Done: true})
+	quiet.PrintSummary()
+	assert.Equal(t, out.Len(), 0, "disabled progress bar wrote output")
+}
+
+func TestRenderLongName(t *testing.T) {
+	bar := NewProgressBar(nil, true, 60)
+	line := bar.render(TransferProgress{Name: strings.Repeat("d/", 40) + "file.bin", Transferred: 1, Total: 2}, time.Second)
+	assert.Equal(t, len(line), 59, "line width not correct")
+	assert.True(t, strings.HasPrefix(line, ".../d/d/"), "name not truncated from the left")
+	assert.True(t, strings.Contains(line, "/file.bin "), "file name not shown")
+}
+
+func TestProgressBarConcurrent(t *testing.T) {
+	var out bytes.Buffer
+	bar := NewProgressBar(&out, true, 80)
+	bar.Update(TransferProgress{Name: "a.bin", Transferred: 100, Total: 1000})
+	bar.Update(TransferProgress{Name: "b.bin", Transferred: 200, Total: 1000})
+	assert.True(t, strings.HasPrefix(out.String()[strings.LastIndex(out.String(), "\r"):], "\r2 files "), "combined progress not shown")
+	assert.True(t, strings.Contains(out.String(), " 15% "), "combined percent not correct")
+
+	bar.Update(TransferProgress{Name: "b.bin", Transferred: 1000, Total: 1000, Done: true})
+	bar.Update(TransferProgress{Name: "a.bin", Transferred: 1000, Total: 1000, Done: true})
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	assert.Equal(t, len(lines), 2, "one line per finished file expected")
+	assert.True(t, strings.Contains(lines[0], "b.bin"), "first finished file not first")
+	assert.True(t, strings.HasPrefix(bar.Summary(), "2 files, 2.0 KiB in "), "summary not correct, failed files are not counted")
+}
@@ -0,0 +1,114 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	askPassEnv        = "SSH_ASKPASS"
+	askPassRequireEnv = "SSH_ASKPASS_REQUIRE"
+)
+
+// ReadSecret prompts for a secret such as a key passphrase without echoing it. Like OpenSSH, the program in
+// SSH_ASKPASS is used when there is no terminal to prompt on, or always when SSH_ASKPASS_REQUIRE=force|prefer.
+// SSH_ASKPASS_REQUIRE=never disables it.
+func ReadSecret(prompt string) (string, error) {
+	askPass := os.Getenv(askPassEnv)
+	require := os.Getenv(askPassRequireEnv)
+	if require == "never" {
+		askPass = ""
+	}
+
+	if askPass != "" && (require == "force" || require == "prefer") {
+		return readSecretAskPass(askPass, prompt)
+	}
+
+	if secret, err := readSecretTerminal(prompt); err == nil {
+		return secret, nil
+	} else if askPass == "" {
+		return "", err
+	}
+	return readSecretAskPass(askPass, prompt)
+}
+
+// openTerminal returns stdin if it is a terminal, otherwise the controlling terminal
+func openTerminal() (*os.File, error) {
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return os.Stdin, nil
+	}
+	tty, err := os.Open(ttyDevice)
+	if err != nil {
+		return nil, fmt.Errorf("no terminal available to prompt for input: %w", err)
+	}
+	return tty, nil
+}
+
+// ReadLine prompts for a line of input on the terminal, with echo
+func ReadLine(prompt string) (string, error) {
+	tty, err := openTerminal()
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if tty != os.Stdin {
+			_ = tty.Close()
+		}
+	}()
+
+	_, _ = fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func readSecretTerminal(prompt string) (string, error) {
+	tty, err := openTerminal()
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if tty != os.Stdin {
+			_ = tty.Close()
+		}
+	}()
+
+	_, _ = fmt.Fprint(os.Stderr, prompt)
+	secret, err := terminal.ReadPassword(int(tty.Fd()))
+	_, _ = fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+func readSecretAskPass(askPass string, prompt string) (string, error) {
+	out, err := exec.Command(askPass, prompt).Output()
+	if err != nil {
+		return "", fmt.Errorf("%s [%s] failed: %w", askPassEnv, askPass, err)
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
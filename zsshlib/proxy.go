@@ -0,0 +1,91 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"io"
+	"net"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func NewProxyCmd(flags *SshFlags) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "proxy <targetIdentity>",
+		Short: "Connect stdin/stdout to the ssh service of the target identity. For use as an OpenSSH ProxyCommand",
+		Long: "Dials the ssh service of the target identity over the ziti network and connects it to stdin/stdout " +
+			"without performing an ssh handshake. This allows OpenSSH based tools to use the ziti network, e.g.:\n\n" +
+			"  ssh -o ProxyCommand='zssh proxy %h' user@targetIdentity",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if flags.Debug {
+				log.SetLevel(logrus.DebugLevel)
+			}
+
+			targetIdentity := ParseTargetIdentity(args[0])
+			cfg := FindConfigByKey(targetIdentity)
+			Combine(cmd, flags, cfg)
+
+			UseTerminalForPrompts()
+			conn := DialTarget(flags, targetIdentity)
+			defer func() { _ = conn.Close() }()
+
+			if err := ProxyStdio(conn); err != nil {
+				log.Fatalf("error proxying to %s: %v", targetIdentity, err)
+			}
+		},
+	}
+
+	flags.AddCommonFlags(cmd)
+	flags.OIDCFlags(cmd)
+	return cmd
+}
+
+// UseTerminalForPrompts moves interactive prompts off of stdin/stdout, which are carrying data. Prompts are
+// written to stderr and read from the controlling terminal, if there is one.
+func UseTerminalForPrompts() {
+	promptOut = os.Stderr
+	if tty, err := os.Open(ttyDevice); err == nil {
+		promptIn = tty
+	} else {
+		log.Debugf("no terminal available for prompts: %v", err)
+		promptIn = eofReader{}
+	}
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+// ProxyStdio copies stdin to conn and conn to stdout. It returns once the remote side closes the connection.
+func ProxyStdio(conn net.Conn) error {
+	go func() {
+		if _, err := io.Copy(conn, os.Stdin); err != nil {
+			log.Debugf("error copying stdin to connection: %v", err)
+		}
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		}
+	}()
+
+	_, err := io.Copy(os.Stdout, conn)
+	return err
+}
@@ -0,0 +1,128 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	randomArtWidth  = 17
+	randomArtHeight = 9
+	// randomArtSymbols are drawn for 0, 1, 2... visits of a cell, followed by the start and end markers
+	randomArtSymbols = " .o+=*BOX@%&#/^SE"
+)
+
+// RandomArt returns the visual host key of key, drawn the same way as OpenSSH's VisualHostKey from the SHA256
+// fingerprint so the two can be compared at a glance
+func RandomArt(key ssh.PublicKey) string {
+	digest := sha256.Sum256(key.Marshal())
+
+	var field [randomArtWidth][randomArtHeight]int
+	maxSymbol := len(randomArtSymbols) - 1
+	x, y := randomArtWidth/2, randomArtHeight/2
+	// the "drunken bishop" walk: each pair of bits moves one step diagonally
+	for _, b := range digest {
+		for i := 0; i < 4; i++ {
+			if b&0x1 != 0 {
+				x++
+			} else {
+				x--
+			}
+			if b&0x2 != 0 {
+				y++
+			} else {
+				y--
+			}
+			x = min(max(x, 0), randomArtWidth-1)
+			y = min(max(y, 0), randomArtHeight-1)
+			if field[x][y] < maxSymbol-2 {
+				field[x][y]++
+			}
+			b >>= 2
+		}
+	}
+	field[randomArtWidth/2][randomArtHeight/2] = maxSymbol - 1
+	field[x][y] = maxSymbol
+
+	title := fmt.Sprintf("[%s %d]", keyTypeName(key), keyBits(key))
+	if len(title) > randomArtWidth {
+		title = "[" + keyTypeName(key) + "]"
+	}
+
+	var sb strings.Builder
+	sb.WriteString(randomArtBorder(title))
+	sb.WriteString("\n")
+	for y := 0; y < randomArtHeight; y++ {
+		sb.WriteString("|")
+		for x := 0; x < randomArtWidth; x++ {
+			sb.WriteByte(randomArtSymbols[min(field[x][y], maxSymbol)])
+		}
+		sb.WriteString("|\n")
+	}
+	sb.WriteString(randomArtBorder("[SHA256]"))
+	return sb.String()
+}
+
+func randomArtBorder(label string) string {
+	left := (randomArtWidth - len(label)) / 2
+	return "+" + strings.Repeat("-", left) + label + strings.Repeat("-", randomArtWidth-left-len(label)) + "+"
+}
+
+// keyTypeName returns the key type the way OpenSSH names it in fingerprints, e.g. ED25519 or RSA
+func keyTypeName(key ssh.PublicKey) string {
+	t := key.Type()
+	suffix := ""
+	if cert, ok := key.(*ssh.Certificate); ok {
+		t = cert.Key.Type()
+		suffix = "-CERT"
+	}
+	switch {
+	case t == ssh.KeyAlgoRSA:
+		return "RSA" + suffix
+	case t == ssh.KeyAlgoED25519:
+		return "ED25519" + suffix
+	case t == ssh.KeyAlgoSKED25519:
+		return "ED25519-SK" + suffix
+	case t == ssh.KeyAlgoSKECDSA256:
+		return "ECDSA-SK" + suffix
+	case strings.HasPrefix(t, "ecdsa-"):
+		return "ECDSA" + suffix
+	}
+	return strings.ToUpper(t) + suffix
+}
+
+func keyBits(key ssh.PublicKey) int {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+	if ck, ok := key.(ssh.CryptoPublicKey); ok {
+		switch pub := ck.CryptoPublicKey().(type) {
+		case *rsa.PublicKey:
+			return pub.N.BitLen()
+		case *ecdsa.PublicKey:
+			return pub.Curve.Params().BitSize
+		}
+	}
+	return 256
+}
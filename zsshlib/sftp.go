@@ -0,0 +1,187 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// DefaultChunkSize is the sftp packet payload size every server has to support
+	DefaultChunkSize = 32768
+	// DefaultMaxRequests is the number of sftp read or write requests kept in flight per file
+	DefaultMaxRequests = 64
+
+	// prefixReadSize is the size of the reads used to hash a remote file over sftp, large enough for the sftp
+	// client to split each into concurrent requests
+	prefixReadSize = 1024 * 1024
+)
+
+// TransferOptions controls how SendFile, RetrieveRemoteFiles and CopyRemoteFile copy a file
+type TransferOptions struct {
+	// Progress, if not nil, is called as data is copied
+	Progress ProgressFunc
+	// Resume continues from the end of an existing partial destination instead of starting over
+	Resume bool
+	// Preserve copies the permission bits and access and modification times of the source
+	Preserve bool
+	// SrcHasher and DstHasher, if not nil, hash the source or destination on its remote when resuming, so the
+	// partial destination can be verified without reading it over the network. They are ignored for local files.
+	SrcHasher *RemoteHasher
+	DstHasher *RemoteHasher
+}
+
+// preservedMode returns the mode bits --preserve copies, permissions plus setuid, setgid and sticky
+func preservedMode(info os.FileInfo) os.FileMode {
+	return info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
+
+// SetRemoteAttributes gives remotePath the permission bits and access and modification times in info
+func SetRemoteAttributes(client *sftp.Client, remotePath string, info os.FileInfo) error {
+	if err := client.Chmod(remotePath, preservedMode(info)); err != nil {
+		return fmt.Errorf("unable to set mode of remote file [%s] (%w)", remotePath, err)
+	}
+	if err := client.Chtimes(remotePath, accessTime(info), info.ModTime()); err != nil {
+		return fmt.Errorf("unable to set times of remote file [%s] (%w)", remotePath, err)
+	}
+	return nil
+}
+
+// accessTime returns the access time in info, which describes a local file or, when copying between remotes,
+// a remote one
+func accessTime(info os.FileInfo) time.Time {
+	if stat, ok := info.Sys().(*sftp.FileStat); ok {
+		return time.Unix(int64(stat.Atime), 0)
+	}
+	return fileAccessTime(info)
+}
+
+// SetLocalAttributes gives localPath the permission bits and access and modification times in the remote info
+func SetLocalAttributes(localPath string, info os.FileInfo) error {
+	if err := os.Chmod(localPath, preservedMode(info)); err != nil {
+		return fmt.Errorf("unable to set mode of local file [%s] (%w)", localPath, err)
+	}
+	if err := os.Chtimes(localPath, accessTime(info), info.ModTime()); err != nil {
+		return fmt.Errorf("unable to set times of local file [%s] (%w)", localPath, err)
+	}
+	return nil
+}
+
+// NewSftpClient opens an sftp session on client. Reads and writes of a file are split into chunkSize requests
+// with up to maxRequests of them in flight, so a transfer isn't limited to one chunk per round trip on
+// high-latency links. Zero values use the defaults.
+func NewSftpClient(client *ssh.Client, chunkSize int, maxRequests int) (*sftp.Client, error) {
+	if chunkSize == 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if maxRequests == 0 {
+		maxRequests = DefaultMaxRequests
+	}
+	if chunkSize > DefaultChunkSize {
+		log.Debugf("using sftp chunk size %d, larger than the %d bytes all servers must support", chunkSize, DefaultChunkSize)
+	}
+	return sftp.NewClient(client,
+		sftp.MaxPacketUnchecked(chunkSize),
+		sftp.MaxConcurrentRequestsPerFile(maxRequests),
+		sftp.UseConcurrentWrites(true),
+		sftp.UseConcurrentReads(true),
+	)
+}
+
+// truncateAfterFailedWrite cuts off f after the data written in sequence when ReadFrom failed. With concurrent
+// writes, writes past the failed one may still have landed and left a hole; pkg/sftp leaves the file offset at the
+// first byte not written. f is closed first, servers finish the writes still in flight on a handle before closing
+// it, so none of them lands after the truncate. If the connection is gone the truncate fails as well, and
+// resumeOffset finds the hole when it compares the partial file with the source.
+func truncateAfterFailedWrite(client *sftp.Client, f *sftp.File) {
+	written, err := f.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_ = f.Close()
+		err = client.Truncate(f.Name(), written)
+	}
+	if err != nil {
+		log.Debugf("unable to truncate [%s] after the failed write: %v", f.Name(), err)
+	}
+}
+
+// prefixChecksumFunc returns the SHA-256 of the first length bytes of a file
+type prefixChecksumFunc func(length int64) ([]byte, error)
+
+// readerPrefixChecksum hashes the start of r, a local file or a remote one read over sftp
+func readerPrefixChecksum(r io.ReaderAt) prefixChecksumFunc {
+	return func(length int64) ([]byte, error) {
+		h := sha256.New()
+		if _, err := io.CopyBuffer(h, io.NewSectionReader(r, 0, length), make([]byte, prefixReadSize)); err != nil {
+			return nil, err
+		}
+		return h.Sum(nil), nil
+	}
+}
+
+// remotePrefixChecksum hashes the start of the remote file f at remotePath on the remote with hasher, or reads it
+// over sftp without one. Remotes that can't hash, like sftp-only accounts or hosts without sha256sum, are read
+// over sftp as well.
+func remotePrefixChecksum(hasher *RemoteHasher, f *sftp.File, remotePath string) prefixChecksumFunc {
+	read := readerPrefixChecksum(f)
+	if hasher == nil {
+		return read
+	}
+	return func(length int64) ([]byte, error) {
+		sum, err := hasher.PrefixChecksum(remotePath, length)
+		if err != nil {
+			log.Debugf("reading [%s] to hash it: %v", remotePath, err)
+			return read(length)
+		}
+		return sum, nil
+	}
+}
+
+// resumeOffset returns where to continue copying the source to the partial destination dstName. The destination is
+// only trusted when it is no longer than the source and all of it matches the start of the source, otherwise the
+// copy starts over from 0. Comparing only its end would miss the holes a write failure can leave in the middle.
+func resumeOffset(srcSum prefixChecksumFunc, srcSize int64, dstSum prefixChecksumFunc, dstSize int64, dstName string) (int64, error) {
+	if dstSize == 0 {
+		return 0, nil
+	}
+	if dstSize > srcSize {
+		log.Warnf("not resuming [%s]: it is larger than the source, starting over", dstName)
+		return 0, nil
+	}
+
+	srcPrefix, err := srcSum(dstSize)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read source to verify [%s] before resuming: %w", dstName, err)
+	}
+	dstPrefix, err := dstSum(dstSize)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read [%s] to verify it before resuming: %w", dstName, err)
+	}
+	if !bytes.Equal(srcPrefix, dstPrefix) {
+		log.Warnf("not resuming [%s]: its content differs from the source, starting over", dstName)
+		return 0, nil
+	}
+	log.Debugf("resuming [%s] at %d of %d bytes", dstName, dstSize, srcSize)
+	return dstSize, nil
+}
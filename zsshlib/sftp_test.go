@@ -0,0 +1,253 @@
+package zsshlib
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+)
+
+// newSftpPipe returns an sftp client served in-process from the local file system
+func newSftpPipe(t *testing.T, opts ...sftp.ClientOption) *sftp.Client {
+	clientRead, serverWrite := io.Pipe()
+	serverRead, clientWrite := io.Pipe()
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{serverRead, serverWrite})
+	assert.NoError(t, err)
+	go func() { _ = server.Serve() }()
+
+	client, err := sftp.NewClientPipe(clientRead, clientWrite, opts...)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		_ = server.Close()
+		_ = serverWrite.Close()
+		_ = client.Close()
+	})
+	return client
+}
+
+func TestSendFile(t *testing.T) {
+	dir := t.TempDir()
+	content := make([]byte, 1<<20+123)
+	_, _ = rand.Read(content)
+	localPath := filepath.Join(dir, "local.bin")
+	assert.NoError(t, os.WriteFile(localPath, content, 0600))
+
+	client := newSftpPipe(t, sftp.MaxPacketUnchecked(4096), sftp.MaxConcurrentRequestsPerFile(8), sftp.UseConcurrentWrites(true))
+	remotePath := filepath.Join(dir, "remote.bin")
+	var last TransferProgress
+	assert.NoError(t, SendFile(client, localPath, remotePath, TransferOptions{Progress: func(p TransferProgress) { last = p }}))
+	assert.True(t, last.Done, "no final progress report")
+	assert.Equal(t, last.Transferred, int64(len(content)), "progress bytes not correct")
+
+	sent, err := os.ReadFile(remotePath)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(sent, content), "sent file content not correct")
+}
+
+func TestResume(t *testing.T) {
+	dir := t.TempDir()
+	content := make([]byte, 300000)
+	_, _ = rand.Read(content)
+	srcPath := filepath.Join(dir, "src.bin")
+	assert.NoError(t, os.WriteFile(srcPath, content, 0600))
+	client := newSftpPipe(t, sftp.MaxPacketUnchecked(4096), sftp.UseConcurrentWrites(true))
+
+	// neither check-file nor a working sha256sum, the echo server fails every command
+	noHasher := NewRemoteHasher(newEchoUpstream(t), client)
+
+	transfers := map[string]func(dst string, opts TransferOptions) error{
+		"send":     func(dst string, opts TransferOptions) error { return SendFile(client, srcPath, dst, opts) },
+		"retrieve": func(dst string, opts TransferOptions) error { return RetrieveRemoteFiles(client, dst, srcPath, opts) },
+	}
+	for name, transfer := range transfers {
+		dst := filepath.Join(dir, name+".bin")
+
+		// a matching prefix is continued
+		assert.NoError(t, os.WriteFile(dst, content[:100000], 0600))
+		var last TransferProgress
+		assert.NoError(t, transfer(dst, TransferOptions{Resume: true, Progress: func(p TransferProgress) { last = p }}))
+		result, _ := os.ReadFile(dst)
+		assert.True(t, bytes.Equal(result, content), name+": resumed file content not correct")
+		assert.Equal(t, last.Offset, int64(100000), name+": transfer did not resume")
+
+		// so it is when the remote can't hash files, the prefix is read over sftp
+		assert.NoError(t, os.WriteFile(dst, content[:100000], 0600))
+		opts := TransferOptions{Resume: true, SrcHasher: noHasher, DstHasher: noHasher, Progress: func(p TransferProgress) { last = p }}
+		assert.NoError(t, transfer(dst, opts))
+		result, _ = os.ReadFile(dst)
+		assert.True(t, bytes.Equal(result, content), name+": resumed file content not correct")
+		assert.Equal(t, last.Offset, int64(100000), name+": transfer without a remote hash did not resume")
+
+		// a prefix that differs from the source starts over
+		corrupt := append([]byte{}, content[:100000]...)
+		corrupt[99999]++
+		assert.NoError(t, os.WriteFile(dst, corrupt, 0600))
+		assert.NoError(t, transfer(dst, TransferOptions{Resume: true, Progress: func(p TransferProgress) { last = p }}))
+		result, _ = os.ReadFile(dst)
+		assert.True(t, bytes.Equal(result, content), name+": restarted file content not correct")
+		assert.Equal(t, last.Offset, int64(0), name+": corrupt prefix was resumed")
+
+		// so does one with a hole a failed concurrent write left in the middle
+		holed := append([]byte{}, content[:200000]...)
+		copy(holed[50000:], make([]byte, 4096))
+		assert.NoError(t, os.WriteFile(dst, holed, 0600))
+		assert.NoError(t, transfer(dst, TransferOptions{Resume: true, Progress: func(p TransferProgress) { last = p }}))
+		result, _ = os.ReadFile(dst)
+		assert.True(t, bytes.Equal(result, content), name+": restarted file content not correct")
+		assert.Equal(t, last.Offset, int64(0), name+": prefix with a hole was resumed")
+	}
+}
+
+// failingWrites is the FilePut handler of an in-memory sftp server whose write covering failAt fails while fail
+// is set, the writes around it succeed
+type failingWrites struct {
+	handler sftp.FileWriter
+	failAt  int64
+	fail    atomic.Bool
+}
+
+type failingFile struct {
+	sftp.WriterAtReaderAt
+	writes *failingWrites
+}
+
+func (w *failingWrites) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	f, err := w.handler.Filewrite(r)
+	if err != nil {
+		return nil, err
+	}
+	return failingFile{f.(sftp.WriterAtReaderAt), w}, nil
+}
+
+func (w *failingWrites) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	f, err := w.handler.(sftp.OpenFileWriter).OpenFile(r)
+	if err != nil {
+		return nil, err
+	}
+	return failingFile{f, w}, nil
+}
+
+func (f failingFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.writes.fail.Load() && off <= f.writes.failAt && f.writes.failAt < off+int64(len(p)) {
+		return 0, fmt.Errorf("injected write failure at %d", off)
+	}
+	return f.WriterAtReaderAt.WriteAt(p, off)
+}
+
+func TestSendFileWriteFailure(t *testing.T) {
+	content := make([]byte, 300000)
+	_, _ = rand.Read(content)
+	srcPath := filepath.Join(t.TempDir(), "src.bin")
+	assert.NoError(t, os.WriteFile(srcPath, content, 0600))
+
+	handlers := sftp.InMemHandler()
+	writes := &failingWrites{handler: handlers.FilePut, failAt: 150000}
+	handlers.FilePut = writes
+	clientRead, serverWrite := io.Pipe()
+	serverRead, clientWrite := io.Pipe()
+	server := sftp.NewRequestServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{serverRead, serverWrite}, handlers)
+	go func() { _ = server.Serve() }()
+	client, err := sftp.NewClientPipe(clientRead, clientWrite, sftp.MaxPacketUnchecked(4096), sftp.UseConcurrentWrites(true))
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		_ = server.Close()
+		_ = client.Close()
+	})
+
+	writes.fail.Store(true)
+	var last TransferProgress
+	assert.Error(t, SendFile(client, srcPath, "/dst.bin", TransferOptions{Progress: func(p TransferProgress) { last = p }}), "write failure not returned")
+	assert.True(t, last.Done && last.Failed, "failed transfer not reported as failed")
+	// the writes after the failed one landed, the file must be cut off before the hole
+	f, err := client.Open("/dst.bin")
+	assert.NoError(t, err)
+	partial, _ := io.ReadAll(f)
+	_ = f.Close()
+	assert.LessOrEqual(t, len(partial), 150000, "data after the failed write kept")
+	assert.True(t, bytes.Equal(partial, content[:len(partial)]), "partial file is not a prefix of the source")
+
+	writes.fail.Store(false)
+	assert.NoError(t, SendFile(client, srcPath, "/dst.bin", TransferOptions{Resume: true, Progress: func(p TransferProgress) { last = p }}))
+	f, err = client.Open("/dst.bin")
+	assert.NoError(t, err)
+	resumed, _ := io.ReadAll(f)
+	_ = f.Close()
+	assert.True(t, bytes.Equal(resumed, content), "resumed file content not correct")
+	assert.Equal(t, last.Offset, int64(len(partial)), "transfer did not resume")
+}
+
+func TestPreserve(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("windows has no unix permission bits")
+	}
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.sh")
+	assert.NoError(t, os.WriteFile(srcPath, []byte("#!/bin/sh\n"), 0600))
+	assert.NoError(t, os.Chmod(srcPath, 0751))
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.NoError(t, os.Chtimes(srcPath, mtime, mtime))
+	client := newSftpPipe(t)
+
+	sent := filepath.Join(dir, "sent.sh")
+	assert.NoError(t, SendFile(client, srcPath, sent, TransferOptions{Preserve: true}))
+	retrieved := filepath.Join(dir, "retrieved.sh")
+	assert.NoError(t, RetrieveRemoteFiles(client, retrieved, srcPath, TransferOptions{Preserve: true}))
+
+	for _, path := range []string{sent, retrieved} {
+		info, err := os.Stat(path)
+		assert.NoError(t, err)
+		assert.Equal(t, info.Mode().Perm(), os.FileMode(0751), "mode not preserved")
+		assert.True(t, info.ModTime().Equal(mtime), "mtime not preserved")
+	}
+
+	// without --preserve a new local file still gets the remote mode, less the umask, rather than 0777
+	plain := filepath.Join(dir, "plain.sh")
+	assert.NoError(t, RetrieveRemoteFiles(client, plain, srcPath, TransferOptions{}))
+	info, _ := os.Stat(plain)
+	assert.Equal(t, info.Mode().Perm()&^0751, os.FileMode(0), "new file has more permissions than the remote file")
+}
+
+func TestCopyRemoteFile(t *testing.T) {
+	dir := t.TempDir()
+	content := make([]byte, 1<<20+321)
+	_, _ = rand.Read(content)
+	srcPath := filepath.Join(dir, "src.bin")
+	assert.NoError(t, os.WriteFile(srcPath, content, 0640))
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.NoError(t, os.Chtimes(srcPath, mtime, mtime))
+	srcClient := newSftpPipe(t, sftp.MaxPacketUnchecked(4096), sftp.UseConcurrentReads(true))
+	dstClient := newSftpPipe(t, sftp.MaxPacketUnchecked(4096), sftp.UseConcurrentWrites(true))
+
+	dstPath := filepath.Join(dir, "dst.bin")
+	var last TransferProgress
+	assert.NoError(t, CopyRemoteFile(srcClient, srcPath, dstClient, dstPath, TransferOptions{Preserve: true, Progress: func(p TransferProgress) { last = p }}))
+	// the pkg/sftp server reports mtime as atime, only mtime can be checked
+	info, _ := os.Stat(dstPath)
+	assert.True(t, info.ModTime().Equal(mtime), "mtime not preserved")
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0640), "mode not preserved")
+	copied, _ := os.ReadFile(dstPath)
+	assert.True(t, bytes.Equal(copied, content), "copied file content not correct")
+	assert.True(t, last.Done, "no final progress report")
+	assert.Equal(t, last.Transferred, int64(len(content)), "progress bytes not correct")
+
+	assert.NoError(t, os.WriteFile(dstPath, content[:500000], 0600))
+	assert.NoError(t, CopyRemoteFile(srcClient, srcPath, dstClient, dstPath, TransferOptions{Resume: true, Progress: func(p TransferProgress) { last = p }}))
+	copied, _ = os.ReadFile(dstPath)
+	assert.True(t, bytes.Equal(copied, content), "resumed file content not correct")
+	assert.Equal(t, last.Offset, int64(500000), "copy did not resume")
+}
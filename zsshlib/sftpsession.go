@@ -0,0 +1,795 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const sftpPrompt = "zsftp> "
+
+// errSessionEnd is returned by Execute for exit, quit and bye
+var errSessionEnd = errors.New("session ended")
+
+type sftpCommand struct {
+	usage string
+	help  string
+	run   func(s *SftpSession, args []string) error
+}
+
+var sftpCommands map[string]sftpCommand
+
+func init() {
+	sftpCommands = map[string]sftpCommand{
+		"bye":    {"bye", "quit zsftp", (*SftpSession).exit},
+		"cd":     {"cd [path]", "change remote directory, to the initial one without a path", (*SftpSession).cd},
+		"chmod":  {"chmod mode path...", "change the octal mode of remote files", (*SftpSession).chmod},
+		"exit":   {"exit", "quit zsftp", (*SftpSession).exit},
+		"get":    {"get [-pr] remote-path [local-path]", "download files. -p preserves modes and times, -r copies directories", (*SftpSession).get},
+		"help":   {"help", "show this help", (*SftpSession).help},
+		"lcd":    {"lcd [path]", "change local directory, to the home directory without a path", (*SftpSession).lcd},
+		"lls":    {"lls [-la] [path]", "list a local directory", (*SftpSession).lls},
+		"lmkdir": {"lmkdir path", "create a local directory", (*SftpSession).lmkdir},
+		"lpwd":   {"lpwd", "print the local directory", (*SftpSession).lpwd},
+		"ls":     {"ls [-la] [path]", "list a remote directory. -l shows details, -a hidden files", (*SftpSession).ls},
+		"mkdir":  {"mkdir path", "create a remote directory", (*SftpSession).mkdir},
+		"put":    {"put [-pr] local-path [remote-path]", "upload files. -p preserves modes and times, -r copies directories", (*SftpSession).put},
+		"pwd":    {"pwd", "print the remote directory", (*SftpSession).pwd},
+		"quit":   {"quit", "quit zsftp", (*SftpSession).exit},
+		"rename": {"rename old-path new-path", "rename a remote file", (*SftpSession).rename},
+		"rm":     {"rm path...", "delete remote files", (*SftpSession).rm},
+		"rmdir":  {"rmdir path", "delete an empty remote directory", (*SftpSession).rmdir},
+	}
+}
+
+// SftpSession runs the commands of an interactive or batch zsftp session. Relative paths are resolved against
+// the session's remote and local directories, remote paths may be globs.
+type SftpSession struct {
+	client     *sftp.Client
+	remoteDir  string
+	remoteHome string
+	localDir   string
+
+	// Out receives command output and progress bars
+	Out io.Writer
+	// Progress enables progress bars Width columns wide for transfers
+	Progress bool
+	Width    int
+	// Verify compares the SHA-256 of every transferred file with its source. Remote files are hashed with
+	// RemoteChecksum, or read back when it is nil.
+	Verify         bool
+	RemoteChecksum ChecksumFunc
+}
+
+// NewSftpSession returns a session starting in the remote directory dir, or the login directory when dir is empty,
+// and the local working directory
+func NewSftpSession(client *sftp.Client, dir string) (*SftpSession, error) {
+	home, err := client.RealPath(".")
+	if err != nil {
+		return nil, fmt.Errorf("cannot find remote home directory (%w)", err)
+	}
+	localDir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	s := &SftpSession{client: client, remoteDir: home, remoteHome: home, localDir: localDir, Out: os.Stdout}
+	if dir != "" {
+		if err := s.cd([]string{dir}); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Execute runs one command line. Blank lines and comments do nothing.
+func (s *SftpSession) Execute(line string) error {
+	args, err := splitCommandLine(line)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 || strings.HasPrefix(args[0], "#") {
+		return nil
+	}
+	if args[0] == "?" {
+		args[0] = "help"
+	}
+	command, ok := sftpCommands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command [%s], try help", args[0])
+	}
+	return command.run(s, args[1:])
+}
+
+// RunBatch executes the commands read from r, echoing each one, and stops at the first command that fails unless
+// it is prefixed with -
+func (s *SftpSession) RunBatch(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		_, _ = fmt.Fprintf(s.Out, "%s%s\n", sftpPrompt, line)
+		ignoreError := strings.HasPrefix(line, "-")
+		err := s.Execute(strings.TrimPrefix(line, "-"))
+		if errors.Is(err, errSessionEnd) {
+			return nil
+		}
+		if err != nil {
+			if !ignoreError {
+				return err
+			}
+			_, _ = fmt.Fprintln(s.Out, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// RunInteractive reads commands from the terminal in until exit or end of input, with tab completion of
+// command names and paths
+func (s *SftpSession) RunInteractive(in *os.File, out io.Writer) error {
+	fd := int(in.Fd())
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = terminal.Restore(fd, state) }()
+
+	term := terminal.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{in, out}, sftpPrompt)
+	term.AutoCompleteCallback = s.Complete
+	if width, height, err := terminal.GetSize(fd); err == nil {
+		_ = term.SetSize(width, height)
+	}
+	s.Out = term
+	for {
+		line, err := term.ReadLine()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := s.Execute(line); errors.Is(err, errSessionEnd) {
+			return nil
+		} else if err != nil {
+			_, _ = fmt.Fprintln(term, err)
+		}
+	}
+}
+
+// Complete is a terminal.Terminal AutoCompleteCallback. Tab completes the word before the cursor as a command
+// name, or as a local or remote path depending on the command and argument, to the longest common prefix of the
+// candidates.
+func (s *SftpSession) Complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+	start := pos
+	for start > 0 && (line[start-1] != ' ' || (start > 1 && line[start-2] == '\\')) {
+		start--
+	}
+	word := strings.ReplaceAll(line[start:pos], `\ `, " ")
+	before := strings.Fields(line[:start])
+
+	var candidates []string
+	var dir string
+	if len(before) == 0 {
+		for name := range sftpCommands {
+			candidates = append(candidates, name+" ")
+		}
+	} else {
+		argIndex := 0
+		for _, arg := range before[1:] {
+			if !strings.HasPrefix(arg, "-") {
+				argIndex++
+			}
+		}
+		local := false
+		switch before[0] {
+		case "lcd", "lls", "lmkdir":
+			local = true
+		case "put":
+			local = argIndex == 0
+		case "get":
+			local = argIndex == 1
+		}
+		var prefix string
+		if local {
+			candidates, dir, prefix = s.localCandidates(word)
+		} else {
+			candidates, dir, prefix = s.remoteCandidates(word)
+		}
+		word = prefix
+	}
+
+	var matches []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, word) && (strings.HasPrefix(word, ".") || !strings.HasPrefix(candidate, ".")) {
+			matches = append(matches, candidate)
+		}
+	}
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+	common := matches[0]
+	for _, match := range matches[1:] {
+		for !strings.HasPrefix(match, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	if common == word {
+		return "", 0, false
+	}
+	completed := strings.ReplaceAll(dir+common, " ", `\ `)
+	if strings.HasSuffix(common, " ") && len(matches) == 1 {
+		// a file name or command is complete, separate it from the next argument
+		completed = strings.TrimSuffix(completed, `\ `) + " "
+	}
+	return line[:start] + completed + line[pos:], start + len(completed), true
+}
+
+// remoteCandidates returns the entries of the remote directory of word, directories with a trailing / and
+// files with a trailing space, along with the directory and name parts of word
+func (s *SftpSession) remoteCandidates(word string) ([]string, string, string) {
+	dir, prefix := path.Split(word)
+	entries, err := s.client.ReadDir(s.remotePath(dir))
+	if err != nil {
+		return nil, dir, prefix
+	}
+	return completionNames(entries), dir, prefix
+}
+
+// localCandidates is remoteCandidates for the local file system
+func (s *SftpSession) localCandidates(word string) ([]string, string, string) {
+	i := strings.LastIndexAny(word, "/"+string(filepath.Separator))
+	dir, prefix := word[:i+1], word[i+1:]
+	entries, err := os.ReadDir(s.localPath(dir))
+	if err != nil {
+		return nil, dir, prefix
+	}
+	var infos []os.FileInfo
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil {
+			infos = append(infos, info)
+		}
+	}
+	return completionNames(infos), dir, prefix
+}
+
+func completionNames(infos []os.FileInfo) []string {
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() {
+			names = append(names, info.Name()+"/")
+		} else {
+			names = append(names, info.Name()+" ")
+		}
+	}
+	return names
+}
+
+// remotePath resolves p against the remote directory. ~ is the initial remote directory.
+func (s *SftpSession) remotePath(p string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		p = s.remoteHome + p[1:]
+	}
+	if path.IsAbs(p) {
+		return path.Clean(p)
+	}
+	return path.Join(s.remoteDir, p)
+}
+
+// localPath resolves p against the local directory. ~ is the user's home directory.
+func (s *SftpSession) localPath(p string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			p = home + p[1:]
+		}
+	}
+	if filepath.IsAbs(p) {
+		return filepath.Clean(p)
+	}
+	return filepath.Join(s.localDir, p)
+}
+
+// remoteGlob resolves p and expands it when it is a pattern. A pattern matching nothing is an error.
+func (s *SftpSession) remoteGlob(p string) ([]string, error) {
+	p = s.remotePath(p)
+	if !strings.ContainsAny(p, "*?[") {
+		return []string{p}, nil
+	}
+	matches, err := s.client.Glob(p)
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("%s: no such file or directory", p)
+	}
+	return matches, nil
+}
+
+func (s *SftpSession) transferOptions(preserve bool) (TransferOptions, *ProgressBar) {
+	progress := NewProgressBar(s.Out, s.Progress, s.Width)
+	return TransferOptions{Progress: progress.Update, Preserve: preserve}, progress
+}
+
+// verify compares the transferred file dstPath with srcPath when Verify is set
+func (s *SftpSession) verify(srcPath string, dstPath string, toRemote bool) error {
+	if !s.Verify {
+		return nil
+	}
+	remote := remoteTree{client: s.client, checksum: s.RemoteChecksum}.Checksum
+	src, dst := ChecksumFunc(LocalChecksum), remote
+	if !toRemote {
+		src, dst = remote, LocalChecksum
+	}
+	sum, err := VerifyTransfer(src, srcPath, dst, dstPath)
+	if err != nil {
+		return err
+	}
+	log.Infof("verified %s: sha256 %x", dstPath, sum)
+	return nil
+}
+
+// parseOptions splits single letter options, e.g. -pr, from the arguments. Options not in allowed are an error.
+func parseOptions(args []string, allowed string) (map[rune]bool, []string, error) {
+	options := map[rune]bool{}
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && len(args[0]) > 1 {
+		for _, option := range args[0][1:] {
+			if !strings.ContainsRune(allowed, option) {
+				return nil, nil, fmt.Errorf("unknown option -%c", option)
+			}
+			options[option] = true
+		}
+		args = args[1:]
+	}
+	return options, args, nil
+}
+
+func argCount(args []string, min int, max int, usage string) error {
+	if len(args) < min || (max >= 0 && len(args) > max) {
+		return fmt.Errorf("usage: %s", usage)
+	}
+	return nil
+}
+
+func (s *SftpSession) exit(_ []string) error {
+	return errSessionEnd
+}
+
+func (s *SftpSession) help(_ []string) error {
+	names := make([]string, 0, len(sftpCommands))
+	for name := range sftpCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		_, _ = fmt.Fprintf(s.Out, "%-38s %s\n", sftpCommands[name].usage, sftpCommands[name].help)
+	}
+	return nil
+}
+
+func (s *SftpSession) cd(args []string) error {
+	if err := argCount(args, 0, 1, sftpCommands["cd"].usage); err != nil {
+		return err
+	}
+	dir := s.remoteHome
+	if len(args) == 1 {
+		dir = s.remotePath(args[0])
+	}
+	info, err := s.client.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("%s: %w", dir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s: not a directory", dir)
+	}
+	s.remoteDir = dir
+	return nil
+}
+
+func (s *SftpSession) lcd(args []string) error {
+	if err := argCount(args, 0, 1, sftpCommands["lcd"].usage); err != nil {
+		return err
+	}
+	dir := s.localPath("~")
+	if len(args) == 1 {
+		dir = s.localPath(args[0])
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s: not a directory", dir)
+	}
+	s.localDir = dir
+	return nil
+}
+
+func (s *SftpSession) pwd(_ []string) error {
+	_, _ = fmt.Fprintf(s.Out, "Remote working directory: %s\n", s.remoteDir)
+	return nil
+}
+
+func (s *SftpSession) lpwd(_ []string) error {
+	_, _ = fmt.Fprintf(s.Out, "Local working directory: %s\n", s.localDir)
+	return nil
+}
+
+func (s *SftpSession) ls(args []string) error {
+	options, args, err := parseOptions(args, "la")
+	if err != nil {
+		return err
+	}
+	if err := argCount(args, 0, 1, sftpCommands["ls"].usage); err != nil {
+		return err
+	}
+	target := "."
+	if len(args) == 1 {
+		target = args[0]
+	}
+	paths, err := s.remoteGlob(target)
+	if err != nil {
+		return err
+	}
+	var infos []os.FileInfo
+	for _, p := range paths {
+		info, err := s.client.Stat(p)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		if !info.IsDir() || len(paths) > 1 {
+			infos = append(infos, info)
+			continue
+		}
+		entries, err := s.client.ReadDir(p)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		infos = append(infos, entries...)
+	}
+	s.list(infos, options['l'], options['a'])
+	return nil
+}
+
+func (s *SftpSession) lls(args []string) error {
+	options, args, err := parseOptions(args, "la")
+	if err != nil {
+		return err
+	}
+	if err := argCount(args, 0, 1, sftpCommands["lls"].usage); err != nil {
+		return err
+	}
+	target := "."
+	if len(args) == 1 {
+		target = args[0]
+	}
+	dir := s.localPath(target)
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	infos := []os.FileInfo{info}
+	if info.IsDir() {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		infos = infos[:0]
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil {
+				infos = append(infos, info)
+			}
+		}
+	}
+	s.list(infos, options['l'], options['a'])
+	return nil
+}
+
+// list prints names one per line, sorted, or in long format with mode, size and modification time
+func (s *SftpSession) list(infos []os.FileInfo, long bool, all bool) {
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	for _, info := range infos {
+		if !all && strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		if long {
+			_, _ = fmt.Fprintf(s.Out, "%s %10d %s %s\n", info.Mode(), info.Size(), info.ModTime().Format("Jan _2 15:04 2006"), info.Name())
+		} else {
+			_, _ = fmt.Fprintln(s.Out, info.Name())
+		}
+	}
+}
+
+func (s *SftpSession) get(args []string) error {
+	options, args, err := parseOptions(args, "pr")
+	if err != nil {
+		return err
+	}
+	if err := argCount(args, 1, 2, sftpCommands["get"].usage); err != nil {
+		return err
+	}
+	sources, err := s.remoteGlob(args[0])
+	if err != nil {
+		return err
+	}
+	dst := s.localDir
+	if len(args) == 2 {
+		dst = s.localPath(args[1])
+	}
+	dstInfo, dstErr := os.Stat(dst)
+	if len(sources) > 1 && (dstErr != nil || !dstInfo.IsDir()) {
+		return fmt.Errorf("%s: destination of multiple files must be a directory", dst)
+	}
+
+	opts, progress := s.transferOptions(options['p'])
+	defer progress.PrintSummary()
+	for _, src := range sources {
+		info, err := s.client.Stat(src)
+		if err != nil {
+			return fmt.Errorf("%s: %w", src, err)
+		}
+		localPath := dst
+		if dstErr == nil && dstInfo.IsDir() {
+			localPath = filepath.Join(dst, path.Base(src))
+		}
+		if info.IsDir() {
+			if !options['r'] {
+				return fmt.Errorf("%s: is a directory, use get -r", src)
+			}
+			if err := s.getTree(src, localPath, opts); err != nil {
+				return err
+			}
+		} else if err := s.getFile(src, localPath, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SftpSession) put(args []string) error {
+	options, args, err := parseOptions(args, "pr")
+	if err != nil {
+		return err
+	}
+	if err := argCount(args, 1, 2, sftpCommands["put"].usage); err != nil {
+		return err
+	}
+	sources, err := filepath.Glob(s.localPath(args[0]))
+	if err != nil {
+		return err
+	}
+	if len(sources) == 0 {
+		return fmt.Errorf("%s: no such file or directory", s.localPath(args[0]))
+	}
+	dst := s.remoteDir
+	if len(args) == 2 {
+		dst = s.remotePath(args[1])
+	}
+	dstInfo, dstErr := s.client.Stat(dst)
+	if len(sources) > 1 && (dstErr != nil || !dstInfo.IsDir()) {
+		return fmt.Errorf("%s: destination of multiple files must be a directory", dst)
+	}
+
+	opts, progress := s.transferOptions(options['p'])
+	defer progress.PrintSummary()
+	for _, src := range sources {
+		info, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		remotePath := dst
+		if dstErr == nil && dstInfo.IsDir() {
+			remotePath = path.Join(dst, filepath.Base(src))
+		}
+		if info.IsDir() {
+			if !options['r'] {
+				return fmt.Errorf("%s: is a directory, use put -r", src)
+			}
+			if err := s.putTree(src, remotePath, opts); err != nil {
+				return err
+			}
+		} else if err := s.putFile(src, remotePath, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SftpSession) getFile(src string, localPath string, opts TransferOptions) error {
+	_, _ = fmt.Fprintf(s.Out, "Fetching %s to %s\n", src, localPath)
+	if err := RetrieveRemoteFiles(s.client, localPath, src, opts); err != nil {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	return s.verify(src, localPath, false)
+}
+
+func (s *SftpSession) putFile(src string, remotePath string, opts TransferOptions) error {
+	_, _ = fmt.Fprintf(s.Out, "Uploading %s to %s\n", src, remotePath)
+	if err := SendFile(s.client, src, remotePath, opts); err != nil {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	return s.verify(src, remotePath, true)
+}
+
+// getTree copies the remote directory src to localPath like sftp get -r: every file is copied, and modes and
+// times are only kept with -p
+func (s *SftpSession) getTree(src string, localPath string, opts TransferOptions) error {
+	var dirs DirectoryAttributes
+	defer dirs.Apply()
+	return WalkRemoteTree(s.client, src, nil, LinksCopy, func(e TreeEntry) error {
+		dst := filepath.Join(localPath, filepath.FromSlash(e.Rel))
+		if !e.Info.IsDir() {
+			return s.getFile(e.Path, dst, opts)
+		}
+		if err := os.Mkdir(dst, e.Info.Mode().Perm()); err != nil && !os.IsExist(err) {
+			return err
+		}
+		if opts.Preserve {
+			dirs.Add(func() error { return SetLocalAttributes(dst, e.Info) })
+		}
+		return nil
+	})
+}
+
+// putTree copies the local directory src to remotePath like sftp put -r
+func (s *SftpSession) putTree(src string, remotePath string, opts TransferOptions) error {
+	var dirs DirectoryAttributes
+	defer dirs.Apply()
+	return WalkLocalTree(src, nil, LinksCopy, func(e TreeEntry) error {
+		dst := path.Join(remotePath, e.Rel)
+		if !e.Info.IsDir() {
+			return s.putFile(e.Path, dst, opts)
+		}
+		if err := s.client.Mkdir(dst); err != nil {
+			if info, statErr := s.client.Stat(dst); statErr != nil || !info.IsDir() {
+				return fmt.Errorf("%s: %w", dst, err)
+			}
+		}
+		if opts.Preserve {
+			dirs.Add(func() error { return SetRemoteAttributes(s.client, dst, e.Info) })
+		}
+		return nil
+	})
+}
+
+func (s *SftpSession) mkdir(args []string) error {
+	if err := argCount(args, 1, 1, sftpCommands["mkdir"].usage); err != nil {
+		return err
+	}
+	return s.client.Mkdir(s.remotePath(args[0]))
+}
+
+func (s *SftpSession) lmkdir(args []string) error {
+	if err := argCount(args, 1, 1, sftpCommands["lmkdir"].usage); err != nil {
+		return err
+	}
+	return os.Mkdir(s.localPath(args[0]), 0755)
+}
+
+func (s *SftpSession) rm(args []string) error {
+	if err := argCount(args, 1, -1, sftpCommands["rm"].usage); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		paths, err := s.remoteGlob(arg)
+		if err != nil {
+			return err
+		}
+		for _, p := range paths {
+			if err := s.client.Remove(p); err != nil {
+				return fmt.Errorf("%s: %w", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *SftpSession) rmdir(args []string) error {
+	if err := argCount(args, 1, 1, sftpCommands["rmdir"].usage); err != nil {
+		return err
+	}
+	return s.client.RemoveDirectory(s.remotePath(args[0]))
+}
+
+func (s *SftpSession) rename(args []string) error {
+	if err := argCount(args, 2, 2, sftpCommands["rename"].usage); err != nil {
+		return err
+	}
+	return s.client.Rename(s.remotePath(args[0]), s.remotePath(args[1]))
+}
+
+func (s *SftpSession) chmod(args []string) error {
+	if err := argCount(args, 2, -1, sftpCommands["chmod"].usage); err != nil {
+		return err
+	}
+	mode, err := strconv.ParseUint(args[0], 8, 32)
+	if err != nil || mode > 07777 {
+		return fmt.Errorf("invalid mode [%s], use octal like 644", args[0])
+	}
+	for _, arg := range args[1:] {
+		paths, err := s.remoteGlob(arg)
+		if err != nil {
+			return err
+		}
+		for _, p := range paths {
+			if err := s.client.Chmod(p, os.FileMode(mode)); err != nil {
+				return fmt.Errorf("%s: %w", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+// splitCommandLine splits line into words at spaces. Single and double quotes group words, a backslash escapes a
+// space, quote or backslash and is kept before anything else, so Windows paths need no quoting.
+func splitCommandLine(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inWord := false
+	var quote rune
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\\' && i+1 < len(runes) && strings.ContainsRune(` '"\`, runes[i+1]):
+			i++
+			current.WriteRune(runes[i])
+			inWord = true
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				args = append(args, current.String())
+				current.Reset()
+				inWord = false
+			}
+		default:
+			current.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inWord {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,150 @@
+package zsshlib
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSftpSession(t *testing.T) (*SftpSession, string, string, *bytes.Buffer) {
+	dir := t.TempDir()
+	remote, local := filepath.Join(dir, "remote"), filepath.Join(dir, "local")
+	assert.NoError(t, os.Mkdir(remote, 0755))
+	assert.NoError(t, os.Mkdir(local, 0755))
+	session, err := NewSftpSession(newSftpPipe(t), remote)
+	assert.NoError(t, err)
+	session.localDir = local
+	var out bytes.Buffer
+	session.Out = &out
+	return session, remote, local, &out
+}
+
+func TestSftpSessionBatch(t *testing.T) {
+	session, remote, local, out := newTestSftpSession(t)
+	assert.NoError(t, os.WriteFile(filepath.Join(local, "a file.txt"), []byte("a"), 0644))
+	assert.NoError(t, os.MkdirAll(filepath.Join(local, "tree", "sub"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(local, "tree", "sub", "b.txt"), []byte("b"), 0644))
+
+	script := strings.Join([]string{
+		"# deploy",
+		`put "a file.txt"`,
+		"put -r tree",
+		"mkdir conf",
+		"cd conf",
+		`rename ../a\ file.txt a.txt`,
+		"chmod 600 a.txt",
+		"-rm missing.txt",
+		"ls -l",
+		"lmkdir back",
+		"lcd back",
+		"get -r " + filepath.ToSlash(remote) + "/tree",
+		"get *.txt",
+		"bye",
+		"rm a.txt",
+	}, "\n")
+	assert.NoError(t, session.RunBatch(strings.NewReader(script)))
+
+	info, err := os.Stat(filepath.Join(remote, "conf", "a.txt"))
+	assert.NoError(t, err, "renamed file missing")
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0600), "chmod not applied")
+	content, _ := os.ReadFile(filepath.Join(local, "back", "tree", "sub", "b.txt"))
+	assert.Equal(t, string(content), "b", "recursive get not correct")
+	content, _ = os.ReadFile(filepath.Join(local, "back", "a.txt"))
+	assert.Equal(t, string(content), "a", "glob get not correct")
+	assert.True(t, strings.Contains(out.String(), "zsftp> ls -l\n-rw------- "), "ls -l output not correct")
+
+	err = session.RunBatch(strings.NewReader("rm missing.txt\nmkdir never"))
+	assert.Error(t, err, "failing command did not stop the batch")
+	_, err = os.Stat(filepath.Join(remote, "conf", "never"))
+	assert.True(t, os.IsNotExist(err), "batch continued after a failing command")
+}
+
+func TestSftpSessionRecursive(t *testing.T) {
+	session, remote, local, out := newTestSftpSession(t)
+	src := filepath.Join(local, "tree", "sub", "b.txt")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(src), 0755))
+	assert.NoError(t, os.WriteFile(src, []byte("b"), 0640))
+	old := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	assert.NoError(t, os.Chtimes(src, old, old))
+	dst := filepath.Join(remote, "tree", "sub", "b.txt")
+
+	// without -p the times are not kept
+	assert.NoError(t, session.Execute("put -r tree"))
+	info, err := os.Stat(dst)
+	assert.NoError(t, err, "file not uploaded")
+	assert.False(t, info.ModTime().Equal(old), "modification time kept without -p")
+	assert.Contains(t, out.String(), "Uploading "+src+" to ", "uploaded file not reported")
+
+	// a destination file of the same size and time is copied again, nothing is skipped
+	assert.NoError(t, os.WriteFile(dst, []byte("x"), 0644))
+	assert.NoError(t, os.Chtimes(dst, old, old))
+	assert.NoError(t, session.Execute("put -rp tree"))
+	content, _ := os.ReadFile(dst)
+	assert.Equal(t, string(content), "b", "unchanged looking file skipped")
+	info, _ = os.Stat(dst)
+	assert.True(t, info.ModTime().Equal(old), "modification time not kept with -p")
+
+	assert.NoError(t, os.Chtimes(dst, time.Now(), time.Now()))
+	assert.NoError(t, session.Execute("lmkdir back"))
+	assert.NoError(t, session.Execute("get -r tree back"))
+	info, err = os.Stat(filepath.Join(local, "back", "tree", "sub", "b.txt"))
+	assert.NoError(t, err, "file not downloaded")
+	assert.False(t, info.ModTime().Equal(old), "modification time kept without -p")
+	assert.Contains(t, out.String(), "Fetching "+filepath.ToSlash(dst)+" to ", "downloaded file not reported")
+}
+
+func TestSftpSessionVerify(t *testing.T) {
+	session, _, local, _ := newTestSftpSession(t)
+	assert.NoError(t, os.WriteFile(filepath.Join(local, "a.txt"), []byte("a"), 0644))
+	assert.NoError(t, os.MkdirAll(filepath.Join(local, "tree"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(local, "tree", "b.txt"), []byte("b"), 0644))
+	session.Verify = true
+	// the pipe serves the local file system, the remote hash is a local one
+	var remoteHashes int
+	session.RemoteChecksum = func(name string) ([]byte, error) {
+		remoteHashes++
+		return LocalChecksum(name)
+	}
+
+	assert.NoError(t, session.RunBatch(strings.NewReader("put a.txt\nput -r tree\nlmkdir back\nget -r tree back")))
+	assert.Equal(t, remoteHashes, 3, "transferred files not verified on the remote")
+
+	session.RemoteChecksum = func(string) ([]byte, error) { return make([]byte, 32), nil }
+	err := session.Execute("put a.txt")
+	assert.ErrorIs(t, err, ErrChecksumMismatch, "mismatch not returned")
+}
+
+func TestSftpSessionComplete(t *testing.T) {
+	session, remote, local, _ := newTestSftpSession(t)
+	assert.NoError(t, os.MkdirAll(filepath.Join(remote, "config dir"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(remote, "config.yml"), nil, 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(remote, "config dir", "app.yml"), nil, 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(local, "upload.bin"), nil, 0644))
+
+	complete := func(line string) string {
+		newLine, _, ok := session.Complete(line, len(line), '\t')
+		if !ok {
+			return line
+		}
+		return newLine
+	}
+	assert.Equal(t, complete("ren"), "rename ", "command not completed")
+	assert.Equal(t, complete("get con"), "get config", "common prefix not completed")
+	assert.Equal(t, complete(`get config\ `), `get config\ dir/`, "directory not completed")
+	assert.Equal(t, complete(`get config\ dir/a`), `get config\ dir/app.yml `, "file not completed")
+	assert.Equal(t, complete("put up"), "put upload.bin ", "local path not completed")
+	assert.Equal(t, complete("put upload.bin con"), "put upload.bin config", "remote path not completed")
+}
+
+func TestSplitCommandLine(t *testing.T) {
+	args, err := splitCommandLine(`put 'my file' "x y" a\ b C:\dir\file`)
+	assert.NoError(t, err)
+	assert.Equal(t, args, []string{"put", "my file", "x y", "a b", `C:\dir\file`}, "arguments not split correctly")
+	_, err = splitCommandLine(`put "open`)
+	assert.Error(t, err, "unterminated quote accepted")
+}
@@ -17,18 +17,15 @@
 package zsshlib
 
 import (
-	"bufio"
-	"encoding/base64"
 	"fmt"
 	"io"
 	"net"
 	"os"
-	"path"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/gorilla/securecookie"
 	"github.com/openziti/sdk-golang/ziti"
@@ -36,7 +33,7 @@ import (
 	"github.com/pkg/sftp"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
@@ -49,79 +46,137 @@ var (
 	DefaultAuthScopes = "openid profile email"
 )
 
-func RemoteShell(client *ssh.Client, args []string) error {
+// SessionOptions controls how RemoteShell sets up the session
+type SessionOptions struct {
+	// Pty requests a pseudo terminal sized to the local terminal and puts the local terminal in raw mode
+	Pty bool
+	// ForwardAgent makes the local ssh agent available to the remote session
+	ForwardAgent bool
+}
+
+// RemoteShell runs args as a remote command, or an interactive shell when args is empty. stdin, stdout and
+// stderr are connected to the session as-is. Without a pty the streams carry raw binary data.
+func RemoteShell(client *ssh.Client, args []string, opts SessionOptions) error {
 	session, err := client.NewSession()
 	if err != nil {
 		return err
 	}
+	defer func() { _ = session.Close() }()
 
-	if len(args) > 0 {
-		if err := session.RequestPty("xterm", 80, 40, ssh.TerminalModes{}); err != nil {
-			logrus.Fatalf("Failed to request pseudo terminal: %v", err)
+	if opts.ForwardAgent {
+		if err := ForwardAgent(client, session); err != nil {
+			log.Warnf("agent forwarding is not available: %v", err)
 		}
+	}
 
-		defer func() { _ = session.Close() }()
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
 
-		stdoutPipe, err := session.StdoutPipe()
-		if err != nil {
-			logrus.Fatal(os.Stderr, "Failed to create stdout pipe:", err)
-		}
+	// stdin is copied here rather than by assigning session.Stdin, which would make session.Wait block on the
+	// next read from a terminal after the remote side has already exited
+	stdinPipe, err := session.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stdin pipe: %w", err)
+	}
+	go func() {
+		_, _ = io.Copy(stdinPipe, os.Stdin)
+		_ = stdinPipe.Close()
+	}()
 
-		stderrPipe, err := session.StderrPipe()
-		if err != nil {
-			logrus.Fatal("Failed to create stderr pipe:", err)
-		}
+	if opts.Pty {
+		stdInFd := int(os.Stdin.Fd())
+		stdOutFd := int(os.Stdout.Fd())
 
-		cmd := strings.Join(args, " ")
-		logrus.Infof("executing remote command: %v", cmd)
-		if err := session.Start(cmd); err != nil {
-			logrus.Fatal("Failed to start command:", err)
+		termWidth, termHeight := 80, 40
+		if terminal.IsTerminal(stdOutFd) {
+			if termWidth, termHeight, err = terminal.GetSize(stdOutFd); err != nil {
+				return fmt.Errorf("unable to determine terminal size: %w", err)
+			}
 		}
 
-		processOutput(stdoutPipe, stderrPipe)
+		if terminal.IsTerminal(stdInFd) {
+			oldState, err := terminal.MakeRaw(stdInFd)
+			if err != nil {
+				return fmt.Errorf("unable to put terminal in raw mode: %w", err)
+			}
+			defer func() { _ = terminal.Restore(stdInFd, oldState) }()
+		}
 
-		// Wait for the command to finish
-		if err := session.Wait(); err != nil {
-			logrus.Fatal("Command execution failed:", err)
+		if err := session.RequestPty("xterm", termHeight, termWidth, ssh.TerminalModes{ssh.ECHO: 1}); err != nil {
+			return fmt.Errorf("failed to request pseudo terminal: %w", err)
 		}
 
-		return nil
+		done := make(chan struct{})
+		defer close(done)
+		go monitorWindowSize(session, stdOutFd, termWidth, termHeight, done)
 	}
 
-	stdInFd := int(os.Stdin.Fd())
-	stdOutFd := int(os.Stdout.Fd())
-
-	oldState, err := terminal.MakeRaw(stdInFd)
-	if err != nil {
-		logrus.Fatal(err)
+	if len(args) > 0 {
+		cmd := strings.Join(args, " ")
+		log.Debugf("executing remote command: %v", cmd)
+		// a non-zero exit is returned as an *ssh.ExitError, see ExitCode
+		return session.Run(cmd)
 	}
-	defer func() {
-		_ = session.Close()
-		_ = terminal.Restore(stdInFd, oldState)
-	}()
 
-	session.Stdout = os.Stdout
-	session.Stderr = os.Stderr
-	session.Stdin = os.Stdin
+	if err := session.Shell(); err != nil {
+		return err
+	}
+	return session.Wait()
+}
 
-	termWidth, termHeight, err := terminal.GetSize(stdOutFd)
+// ForwardAgent serves agent requests from the remote side of client using the local ssh agent and requests agent
+// forwarding on the session
+func ForwardAgent(client *ssh.Client, session *ssh.Session) error {
+	conn, err := dialAgent()
 	if err != nil {
-		logrus.Fatal(err)
+		return fmt.Errorf("could not connect to the local ssh agent: %w", err)
 	}
-
-	if err := session.RequestPty("xterm", termHeight, termWidth, ssh.TerminalModes{ssh.ECHO: 1}); err != nil {
+	if err := agent.ForwardToAgent(client, agent.NewClient(conn)); err != nil {
+		_ = conn.Close()
 		return err
 	}
+	return agent.RequestAgentForwarding(session)
+}
 
-	err = session.Shell()
-	if err != nil {
-		return err
+// monitorWindowSize sends a window-change request on the session each time the local terminal is resized
+func monitorWindowSize(session *ssh.Session, fd int, width int, height int, done <-chan struct{}) {
+	events := windowChangeEvents(done)
+	for {
+		select {
+		case <-done:
+			return
+		case <-events:
+			w, h, err := terminal.GetSize(fd)
+			if err != nil {
+				log.Debugf("unable to read terminal size: %v", err)
+				continue
+			}
+			if w == width && h == height {
+				continue
+			}
+			width, height = w, h
+			if err := session.WindowChange(height, width); err != nil {
+				log.Debugf("unable to send window-change: %v", err)
+				return
+			}
+		}
 	}
-	err = session.Wait()
-	if err != nil {
-		return err
+}
+
+// ExitCode returns the process exit code zssh should use for an error returned by RemoteShell. When the
+// remote command exited non-zero the remote exit status is returned; a command killed by a signal is
+// reported as 128+N by the ssh library. ok is false when err does not describe a remote exit.
+func ExitCode(err error) (code int, ok bool) {
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), true
 	}
-	return nil
+	var missingErr *ssh.ExitMissingError
+	if errors.As(err, &missingErr) {
+		// matches OpenSSH, which exits 255 when the remote status is unknown
+		return 255, true
+	}
+	return 0, false
 }
 
 func Dial(config *ssh.ClientConfig, conn net.Conn) (*ssh.Client, error) {
@@ -156,24 +211,34 @@ type SshConfigFactory interface {
 	Port() int
 	User() string
 	Config() *ssh.ClientConfig
-	KeyPath() string
+	KeyPaths() []string
 }
 
 type SshConfigFactoryImpl struct {
 	user            string
 	host            string
 	port            int
-	keyPath         string
-	resolveAuthOnce sync.Once
-	authMethods     []ssh.AuthMethod
+	keyPaths        []string
+	certificateFile string
+	passwordPrompts int
+	batchMode       bool
+	knownHosts      *KnownHosts
+	// preferredAuthentications are the auth methods to use, in order. see AuthPublicKey etc
+	preferredAuthentications []string
+	resolveAuthOnce          sync.Once
+	authMethods              []ssh.AuthMethod
 }
 
-func NewSshConfigFactoryImpl(user string, keyPath string) *SshConfigFactoryImpl {
+func NewSshConfigFactoryImpl(user string, keyPaths ...string) *SshConfigFactoryImpl {
 	factory := &SshConfigFactoryImpl{
-		user:    user,
-		host:    "",
-		port:    22,
-		keyPath: keyPath,
+		user:            user,
+		host:            "",
+		port:            22,
+		keyPaths:        keyPaths,
+		passwordPrompts: DefaultConfig().PasswordPrompts,
+		knownHosts:      &KnownHosts{Hash: true},
+
+		preferredAuthentications: DefaultConfig().PreferredAuthentications,
 	}
 	return factory
 }
@@ -189,8 +254,8 @@ func (factory *SshConfigFactoryImpl) Port() int {
 	return factory.port
 }
 
-func (factory *SshConfigFactoryImpl) KeyPath() string {
-	return factory.keyPath
+func (factory *SshConfigFactoryImpl) KeyPaths() []string {
+	return factory.keyPaths
 }
 
 func (factory *SshConfigFactoryImpl) Address() string {
@@ -200,98 +265,319 @@ func (factory *SshConfigFactoryImpl) Address() string {
 func (factory *SshConfigFactoryImpl) Config() *ssh.ClientConfig {
 	factory.resolveAuthOnce.Do(func() {
 		var methods []ssh.AuthMethod
-
-		if fileMethod, err := sshAuthMethodFromFile(factory.keyPath); err == nil {
-			methods = append(methods, fileMethod)
-		} else {
-			logrus.Error(err)
-		}
-
-		if agentMethod := sshAuthMethodAgent(); agentMethod != nil {
-			methods = append(methods, sshAuthMethodAgent())
+		for _, name := range factory.preferredAuthentications {
+			switch name {
+			case AuthPublicKey:
+				methods = append(methods, ssh.PublicKeysCallback(factory.publicKeySigners))
+			case AuthKeyboardInteractive:
+				if !factory.batchMode {
+					methods = append(methods, ssh.RetryableAuthMethod(ssh.KeyboardInteractive(keyboardInteractiveChallenge), factory.passwordPrompts))
+				}
+			case AuthPassword:
+				if !factory.batchMode {
+					methods = append(methods, ssh.RetryableAuthMethod(ssh.PasswordCallback(passwordPrompt(factory.user)), factory.passwordPrompts))
+				}
+			default:
+				log.Warnf("ignoring unsupported authentication method: %s", name)
+			}
 		}
-
-		methods = append(methods)
-
 		factory.authMethods = methods
 	})
 
 	return &ssh.ClientConfig{
 		User:            factory.user,
 		Auth:            factory.authMethods,
-		HostKeyCallback: hostKeyCallback,
+		HostKeyCallback: factory.knownHosts.HostKeyCallback,
 	}
 }
 
-func sshAuthMethodFromFile(keyPath string) (ssh.AuthMethod, error) {
+// publicKeySigners returns every signer to offer for publickey authentication. The ssh client does not try a
+// second publickey auth method once one has failed, so the key files and the agent are offered through this one
+// callback. Keys without a passphrase come first, then the agent, then encrypted keys, which may already be in the
+// agent and only prompt for their passphrase once the server accepts them.
+func (factory *SshConfigFactoryImpl) publicKeySigners() ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	var encryptedSigners []ssh.Signer
+
+	defaultKeys := DefaultIdentityFiles()
+	for _, keyPath := range factory.keyPaths {
+		fileSigners, encrypted, err := signersFromFile(keyPath, factory.certificateFile, factory.passwordPrompts, factory.batchMode)
+		if err != nil {
+			// the default keys are only probed, most users will not have all of them
+			if slices.Contains(defaultKeys, keyPath) {
+				log.Debug(err)
+			} else {
+				logrus.Error(err)
+			}
+		} else if encrypted {
+			encryptedSigners = append(encryptedSigners, fileSigners...)
+		} else {
+			signers = append(signers, fileSigners...)
+		}
+	}
+
+	if agentSigners := sshAgentSigners(); agentSigners != nil {
+		if s, err := agentSigners(); err == nil {
+			signers = append(signers, s...)
+		} else {
+			log.Debugf("unable to list ssh agent keys: %v", err)
+		}
+	}
+
+	return append(signers, encryptedSigners...), nil
+}
+
+// signersFromFile returns the signers for the private key in keyPath, with a matching certificate first if there
+// is one. If the key is encrypted, encrypted is true and the passphrase is prompted for, up to passwordPrompts
+// times. Encrypted keys are skipped in batch mode.
+func signersFromFile(keyPath string, certificateFile string, passwordPrompts int, batchMode bool) (signers []ssh.Signer, encrypted bool, err error) {
 	content, err := os.ReadFile(keyPath)
 	if err != nil {
-		return nil, fmt.Errorf("could not read zssh file [%s]: %w", keyPath, err)
+		return nil, false, fmt.Errorf("could not read zssh file [%s]: %w", keyPath, err)
 	}
 	_, _, _, _, pubkeyErr := ssh.ParseAuthorizedKey(content)
 	if pubkeyErr == nil {
 		log.Fatal("the provided key for ssh authentication is a public key, but a private key is required")
 	}
 
-	if signer, err := ssh.ParsePrivateKey(content); err == nil {
-		return ssh.PublicKeys(signer), nil
-	} else {
-		if err.Error() == "zssh: no key found" {
-			return nil, fmt.Errorf("no private key found in [%s]: %w", keyPath, err)
-		} else if err.(*ssh.PassphraseMissingError) != nil {
-			return nil, fmt.Errorf("file is password protected [%s] %w", keyPath, err)
-		} else {
-			return nil, fmt.Errorf("error parsing private key from [%s]L %w", keyPath, err)
+	signer, err := ssh.ParsePrivateKey(content)
+	if err == nil {
+		return certificateSigners(keyPath, certificateFile, signer), false, nil
+	}
+
+	var passphraseErr *ssh.PassphraseMissingError
+	if err.Error() == "zssh: no key found" {
+		return nil, false, fmt.Errorf("no private key found in [%s]: %w", keyPath, err)
+	} else if errors.As(err, &passphraseErr) {
+		if batchMode {
+			return nil, true, fmt.Errorf("not prompting for the passphrase of [%s] in batch mode", keyPath)
+		}
+		signer, err := newEncryptedKeySigner(keyPath, content, passwordPrompts)
+		if err != nil {
+			return nil, true, err
 		}
+		return certificateSigners(keyPath, certificateFile, signer), true, nil
+	} else {
+		return nil, false, fmt.Errorf("error parsing private key from [%s]L %w", keyPath, err)
 	}
 }
 
-func SendFile(client *sftp.Client, localPath string, remotePath string) error {
-	localFile, err := os.ReadFile(localPath)
-
+// SendFile streams localPath to remotePath. The file is never held in memory as a whole, chunks are written with
+// as many requests in flight as the sftp client allows.
+func SendFile(client *sftp.Client, localPath string, remotePath string, opts TransferOptions) (err error) {
+	localFile, err := os.Open(localPath)
 	if err != nil {
-		return errors.Wrapf(err, "unable to read local file %v", localFile)
+		return errors.Wrapf(err, "unable to read local file %v", localPath)
+	}
+	defer func() { _ = localFile.Close() }()
+	info, err := localFile.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "unable to stat local file %v", localPath)
 	}
 
-	rmtFile, err := client.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
-
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if opts.Resume {
+		// the partial file is read back to verify it
+		flags = os.O_RDWR | os.O_CREATE
+	}
+	rmtFile, err := client.OpenFile(remotePath, flags)
 	if err != nil {
 		return errors.Wrapf(err, "unable to open remote file %v", remotePath)
 	}
 	defer func() { _ = rmtFile.Close() }()
 
-	_, err = rmtFile.Write(localFile)
-	if err != nil {
+	var offset int64
+	if opts.Resume {
+		rmtInfo, err := rmtFile.Stat()
+		if err != nil {
+			return errors.Wrapf(err, "unable to stat remote file %v", remotePath)
+		}
+		if offset, err = resumeOffset(readerPrefixChecksum(localFile), info.Size(), remotePrefixChecksum(opts.DstHasher, rmtFile, remotePath), rmtInfo.Size(), remotePath); err != nil {
+			return err
+		}
+		if offset == 0 && rmtInfo.Size() > 0 {
+			if err := rmtFile.Truncate(0); err != nil {
+				return errors.Wrapf(err, "unable to truncate remote file %v", remotePath)
+			}
+		}
+		if _, err := localFile.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := rmtFile.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	var src io.Reader = localFile
+	if opts.Progress != nil {
+		reader := &progressReader{r: localFile, name: localPath, offset: offset, transferred: offset, total: info.Size(), progress: opts.Progress}
+		defer func() { opts.Progress(reader.finish(err)) }()
+		src = reader
+	}
+
+	if _, err := rmtFile.ReadFrom(src); err != nil {
+		truncateAfterFailedWrite(client, rmtFile)
 		return err
 	}
 
+	if err := rmtFile.Close(); err != nil {
+		return err
+	}
+	if opts.Preserve {
+		return SetRemoteAttributes(client, remotePath, info)
+	}
 	return nil
 }
 
-func RetrieveRemoteFiles(client *sftp.Client, localPath string, remotePath string) error {
+// RetrieveRemoteFiles copies remotePath to localPath
+func RetrieveRemoteFiles(client *sftp.Client, localPath string, remotePath string, opts TransferOptions) (err error) {
 
 	rf, err := client.Open(remotePath)
 	if err != nil {
 		return fmt.Errorf("error opening remote file [%s] (%w)", remotePath, err)
 	}
 	defer func() { _ = rf.Close() }()
+	info, err := rf.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading remote file size [%s] (%w)", remotePath, err)
+	}
 
-	lf, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if opts.Resume {
+		flags = os.O_RDWR | os.O_CREATE
+	}
+	// like a new remote file, a new local file gets the mode of its source less the umask
+	lf, err := os.OpenFile(localPath, flags, info.Mode().Perm())
 	if err != nil {
 		return fmt.Errorf("error opening local file [%s] (%w)", localPath, err)
 	}
 	defer func() { _ = lf.Close() }()
 
-	_, err = io.Copy(lf, rf)
+	var offset int64
+	if opts.Resume {
+		localInfo, err := lf.Stat()
+		if err != nil {
+			return fmt.Errorf("error reading local file size [%s] (%w)", localPath, err)
+		}
+		if offset, err = resumeOffset(remotePrefixChecksum(opts.SrcHasher, rf, remotePath), info.Size(), readerPrefixChecksum(lf), localInfo.Size(), localPath); err != nil {
+			return err
+		}
+		if err := lf.Truncate(offset); err != nil {
+			return fmt.Errorf("error truncating local file [%s] (%w)", localPath, err)
+		}
+		if _, err := lf.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := rf.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	var dst io.Writer = lf
+	if opts.Progress != nil {
+		writer := &progressWriter{w: lf, name: remotePath, offset: offset, transferred: offset, total: info.Size(), progress: opts.Progress}
+		defer func() { opts.Progress(writer.finish(err)) }()
+		dst = writer
+	}
+
+	_, err = io.Copy(dst, rf)
 	if err != nil {
 		return fmt.Errorf("error copying remote file to local [%s] (%w)", remotePath, err)
 	}
+	if err := lf.Close(); err != nil {
+		return fmt.Errorf("error closing local file [%s] (%w)", localPath, err)
+	}
+	if opts.Preserve {
+		if err := SetLocalAttributes(localPath, info); err != nil {
+			return err
+		}
+	}
 	logrus.Infof("%s => %s", remotePath, localPath)
 
 	return nil
 }
 
-func EstablishClient(f *SshFlags, target string, targetIdentity string) *ssh.Client {
+// CopyRemoteFile streams srcPath on one remote to dstPath on another through this process, nothing is written to
+// local disk. Both sides keep as many requests in flight as their sftp clients allow.
+func CopyRemoteFile(srcClient *sftp.Client, srcPath string, dstClient *sftp.Client, dstPath string, opts TransferOptions) (err error) {
+	srcFile, err := srcClient.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("error opening remote file [%s] (%w)", srcPath, err)
+	}
+	defer func() { _ = srcFile.Close() }()
+	info, err := srcFile.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading remote file size [%s] (%w)", srcPath, err)
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if opts.Resume {
+		flags = os.O_RDWR | os.O_CREATE
+	}
+	dstFile, err := dstClient.OpenFile(dstPath, flags)
+	if err != nil {
+		return fmt.Errorf("error opening remote file [%s] (%w)", dstPath, err)
+	}
+	defer func() { _ = dstFile.Close() }()
+
+	var offset int64
+	if opts.Resume {
+		dstInfo, err := dstFile.Stat()
+		if err != nil {
+			return fmt.Errorf("error reading remote file size [%s] (%w)", dstPath, err)
+		}
+		if offset, err = resumeOffset(remotePrefixChecksum(opts.SrcHasher, srcFile, srcPath), info.Size(), remotePrefixChecksum(opts.DstHasher, dstFile, dstPath), dstInfo.Size(), dstPath); err != nil {
+			return err
+		}
+		if err := dstFile.Truncate(offset); err != nil {
+			return fmt.Errorf("error truncating remote file [%s] (%w)", dstPath, err)
+		}
+		if _, err := srcFile.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := dstFile.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	// the source is read with concurrent requests into the pipe while the destination is written with
+	// concurrent requests from it
+	pipeReader, pipeWriter := io.Pipe()
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		_, err := srcFile.WriteTo(pipeWriter)
+		_ = pipeWriter.CloseWithError(err)
+	}()
+
+	progress := opts.Progress
+	if progress == nil {
+		progress = func(TransferProgress) {}
+	}
+	// the reader's Size sizes the concurrent writes
+	reader := &progressReader{r: pipeReader, name: srcPath, offset: offset, transferred: offset, total: info.Size(), progress: progress}
+	defer func() { progress(reader.finish(err)) }()
+	_, err = dstFile.ReadFrom(reader)
+	_ = pipeReader.CloseWithError(io.ErrClosedPipe)
+	<-readDone
+	if err != nil {
+		// the bytes read from the pipe are not the bytes written, cut the file where the writes stopped being
+		// sequential so --resume can continue from it
+		truncateAfterFailedWrite(dstClient, dstFile)
+		return fmt.Errorf("error copying [%s] to [%s] (%w)", srcPath, dstPath, err)
+	}
+
+	if err := dstFile.Close(); err != nil {
+		return fmt.Errorf("error closing remote file [%s] (%w)", dstPath, err)
+	}
+	if opts.Preserve {
+		return SetRemoteAttributes(dstClient, dstPath, info)
+	}
+	return nil
+}
+
+// DialTarget authenticates to the ziti network and dials the service bound by targetIdentity
+func DialTarget(f *SshFlags, targetIdentity string) net.Conn {
 	ctx := NewContext(f, true)
 	Auth(ctx)
 
@@ -308,15 +594,28 @@ func EstablishClient(f *SshFlags, target string, targetIdentity string) *ssh.Cli
 	if err != nil {
 		log.Fatalf("error when dialing service name %s. %v", f.ServiceName, err)
 	}
-	username := ParseUserName(target, false)
-	if username == "" {
-		if f.Username == "" {
-			username = ParseUserName(target, true)
-		} else {
-			username = f.Username
-		}
-	}
-	factory := NewSshConfigFactoryImpl(username, f.SshKeyPath)
+	return svc
+}
+
+func EstablishClient(f *SshFlags, target string, targetIdentity string) *ssh.Client {
+	svc := DialTarget(f, targetIdentity)
+	factory := NewSshConfigFactoryImpl(f.ResolveUserName(target), f.SshKeyPaths...)
+	factory.passwordPrompts = f.PasswordPrompts
+	factory.certificateFile = f.CertificateFile
+	factory.batchMode = f.BatchMode
+	factory.knownHosts = &KnownHosts{
+		Alias:                 KnownHostsAlias(f.ServiceName, targetIdentity),
+		Principal:             targetIdentity,
+		HostCAKeys:            f.HostCAKeys,
+		RevokedHostKeys:       f.RevokedHostKeys,
+		Hash:                  f.HashKnownHosts,
+		StrictHostKeyChecking: f.StrictHostKeyChecking,
+	}
+	if f.BatchMode && f.StrictHostKeyChecking == StrictHostKeyCheckingAsk {
+		// there is no one to ask, like OpenSSH BatchMode
+		factory.knownHosts.StrictHostKeyChecking = StrictHostKeyCheckingYes
+	}
+	factory.preferredAuthentications = f.PreferredAuthentications
 	config := factory.Config()
 	sshConn, err := Dial(config, svc)
 	if err != nil {
@@ -348,161 +647,3 @@ func AppendBaseName(c *sftp.Client, remotePath string, localPath string, debug b
 	}
 	return remotePath
 }
-
-// processOutput processes the stdout and stderr streams concurrently
-func processOutput(stdout io.Reader, stderr io.Reader) {
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	// Goroutine to process stdout
-	go func() {
-		defer wg.Done()
-		if _, err := io.Copy(os.Stdout, stdout); err != nil {
-			log.Fatalf("Error copying stdout: %v", err)
-		}
-	}()
-
-	// Goroutine to process stderr
-	go func() {
-		defer wg.Done()
-		if _, err := io.Copy(os.Stderr, stderr); err != nil {
-			log.Fatalf("Error copying stderr: %v", err)
-		}
-	}()
-
-	// Wait for both goroutines to finish
-	wg.Wait()
-}
-
-type zitiEdgeConnAdapter struct {
-	orig net.Addr
-}
-
-func (a zitiEdgeConnAdapter) Network() string {
-	return ""
-}
-func (a zitiEdgeConnAdapter) String() string {
-	// ziti connections will have the format: "ziti-edge-router connId=%v, logical=%v", e.MsgCh.Id(), e.MsgCh.LogicalName()
-	// see ziti/edge/addr.go in github.com/openziti/sdk-golang if it changes
-	// example: ziti-edge-router connId=1, logical=ziti-sdk[router=tls:ec2-3-18-113-172.us-east-2.compute.amazonaws.com:8442]
-	parts := strings.Split(a.orig.String(), ":")
-	answer := strings.Join(parts[len(parts)-2:], ":")
-	answer = strings.ReplaceAll(answer, "]", "")
-	return answer
-}
-
-func keyToString(k ssh.PublicKey) string {
-	return k.Type() + " " + base64.StdEncoding.EncodeToString(k.Marshal())
-}
-
-func hostKeyCallback(hostname string, remote net.Addr, key ssh.PublicKey) error {
-	var keyErr *knownhosts.KeyError
-	remoteCopy := zitiEdgeConnAdapter{
-		orig: remote,
-	}
-
-	if err := ensureKnownHosts(); err != nil {
-		return err
-	}
-
-	knownHosts := knownHostsFile()
-
-	cb, err := knownhosts.New(knownHosts)
-	if err != nil {
-		return err
-	}
-
-	err = cb(hostname, remoteCopy, key)
-	if err != nil {
-		if err.Error() == "knownhosts: key is unknown" {
-			log.Warnf("key is not known: %s", keyToString(key))
-			time.Sleep(50 * time.Millisecond)
-			fmt.Print("do you want to add this key to your known_hosts file? (N/y): ")
-
-			reader := bufio.NewReader(os.Stdin)
-			answer, readerr := reader.ReadString('\n')
-			if readerr != nil {
-				log.Fatalf("error reading line: %v", readerr)
-			}
-
-			if strings.ToLower(answer)[:1] == "y" {
-				adderr := addKnownHostUnhashed(remoteCopy.String(), key)
-				if adderr != nil {
-					log.Fatalf("error adding key to known_hosts: %v", adderr)
-				}
-				log.Infof("added key to known_hosts: %s", keyToString(key))
-
-				cb, err = knownhosts.New(knownHosts)
-				if err != nil {
-					return err
-				}
-				err = cb(hostname, remoteCopy, key)
-			} else {
-				os.Exit(1)
-			}
-		}
-	}
-
-	// Make sure that the error returned from the callback is host not in file error.
-	// If keyErr.Want is greater than 0 length, that means host is in file with different key.
-	if errors.As(err, &keyErr) && len(keyErr.Want) > 0 {
-		return keyErr
-	}
-
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func ensureKnownHosts() error {
-	filePath := knownHostsFile()
-	_, err := os.Stat(filePath)
-	if os.IsNotExist(err) {
-		// Create the directories if they don't exist
-		dir := filepath.Dir(filePath)
-		if err := os.MkdirAll(dir, 0700); err != nil {
-			return fmt.Errorf("failed to create directories: %w", err)
-		}
-
-		// Create the file with 0600 permissions
-		file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0600)
-		if err != nil {
-			return fmt.Errorf("failed to create file: %w", err)
-		}
-		defer file.Close()
-	} else if err != nil {
-		return fmt.Errorf("error checking file: %w", err)
-	}
-
-	return nil
-}
-
-func knownHostsFile() string {
-	home, err := os.UserHomeDir()
-	if err != nil {
-		log.Fatalf("unable to determine home directory - cannot find known_hosts file: %v", err)
-	}
-	return path.Join(home, ".ssh", "known_hosts")
-}
-
-// couldn't get the openssh hashing to work yet. unhashed works and it's good enoguh for now.
-func addKnownHostUnhashed(hostname string, key ssh.PublicKey) error {
-	knownHosts := knownHostsFile()
-	f, err := os.OpenFile(knownHosts, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
-	if err != nil {
-		return err
-	}
-	defer func() { _ = f.Close() }()
-
-	keyBytes := key.Marshal()
-	keyString := base64.StdEncoding.EncodeToString(keyBytes)
-	entry := fmt.Sprintf("%s %s %s\n", knownhosts.Normalize(hostname), key.Type(), keyString)
-
-	if _, err := f.WriteString(entry); err != nil {
-		return fmt.Errorf("failed to write to known_hosts file: %v", err)
-	}
-
-	return err
-}
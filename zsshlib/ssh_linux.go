@@ -21,11 +21,56 @@ import (
 	"golang.org/x/crypto/ssh/agent"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
-func sshAuthMethodAgent() ssh.AuthMethod {
-	if sshAgent, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK")); err == nil {
-		return ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers)
+// ttyDevice is the controlling terminal, used for prompts when stdin is in use
+const ttyDevice = "/dev/tty"
+
+func dialAgent() (net.Conn, error) {
+	return net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+}
+
+func sshAgentSigners() func() ([]ssh.Signer, error) {
+	if sshAgent, err := dialAgent(); err == nil {
+		return agentSigners(agent.NewClient(sshAgent))
 	}
 	return nil
 }
+
+// windowChangeEvents signals on the returned channel whenever the terminal receives SIGWINCH, until done is closed
+func windowChangeEvents(done <-chan struct{}) <-chan struct{} {
+	events := make(chan struct{}, 1)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGWINCH)
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-done:
+				return
+			case <-sigs:
+				select {
+				case events <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return events
+}
+
+// controlMasterProcAttr starts the control master in its own session so it outlives the invoking terminal
+func controlMasterProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
+
+// fileAccessTime returns the last access time of a local file, or its modification time if unknown
+func fileAccessTime(info os.FileInfo) time.Time {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(stat.Atim.Unix())
+	}
+	return info.ModTime()
+}
@@ -1,11 +1,17 @@
 package zsshlib
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
 	"github.com/pkg/sftp"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
 	"net"
 	"os"
 	"path/filepath"
+	"runtime"
 	"testing"
 )
 
@@ -32,3 +38,103 @@ func TestAppendBaseName(t *testing.T) {
 	result = AppendBaseName(client, "message.txt", "message.txt", false)
 	assert.Equal(t, result, "message.txt", "Path not correct")
 }
+
+func TestExitCode(t *testing.T) {
+	code, ok := ExitCode(&ssh.ExitMissingError{})
+	assert.True(t, ok)
+	assert.Equal(t, code, 255, "exit code not correct")
+
+	code, ok = ExitCode(fmt.Errorf("wrapped: %w", &ssh.ExitMissingError{}))
+	assert.True(t, ok)
+	assert.Equal(t, code, 255, "exit code not correct")
+
+	_, ok = ExitCode(fmt.Errorf("failed to start command"))
+	assert.False(t, ok)
+}
+
+func TestEncryptedKeyDecrypter(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("askpass script requires a posix shell")
+	}
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte("secret"))
+	assert.NoError(t, err)
+	content := pem.EncodeToMemory(block)
+
+	dir := t.TempDir()
+	askPass := filepath.Join(dir, "askpass")
+	assert.NoError(t, os.WriteFile(askPass, []byte("#!/bin/sh\necho secret\n"), 0700))
+	t.Setenv(askPassEnv, askPass)
+	t.Setenv(askPassRequireEnv, "force")
+
+	signer, err := encryptedKeyDecrypter("test-key", content, 3)()
+	assert.NoError(t, err)
+	assert.NotNil(t, signer, "signer not returned")
+
+	assert.NoError(t, os.WriteFile(askPass, []byte("#!/bin/sh\necho wrong\n"), 0700))
+	_, err = encryptedKeyDecrypter("test-key", content, 2)()
+	assert.Error(t, err)
+}
+
+func TestConfigAuthMethods(t *testing.T) {
+	factory := NewSshConfigFactoryImpl("test")
+	assert.Equal(t, len(factory.Config().Auth), 3, "auth methods not correct")
+
+	factory = NewSshConfigFactoryImpl("test")
+	factory.batchMode = true
+	assert.Equal(t, len(factory.Config().Auth), 1, "prompting auth methods used in batch mode")
+
+	factory = NewSshConfigFactoryImpl("test")
+	factory.preferredAuthentications = []string{AuthPassword, "gssapi-with-mic"}
+	assert.Equal(t, len(factory.Config().Auth), 1, "auth methods not correct")
+}
+
+func TestPublicKeyAuthTriesEveryKey(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	dir := t.TempDir()
+	var keyPaths []string
+	var authorized ssh.PublicKey
+	for _, name := range []string{"id_first", "id_second"} {
+		_, key, _ := ed25519.GenerateKey(rand.Reader)
+		block, err := ssh.MarshalPrivateKey(key, "")
+		assert.NoError(t, err)
+		keyPath := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600))
+		keyPaths = append(keyPaths, keyPath)
+		signer, _ := ssh.NewSignerFromKey(key)
+		authorized = signer.PublicKey()
+	}
+
+	_, hostKey, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, _ := ssh.NewSignerFromKey(hostKey)
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("key not authorized")
+		},
+	}
+	serverConfig.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+	go func() {
+		serverConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		if conn, _, _, err := ssh.NewServerConn(serverConn, serverConfig); err == nil {
+			_ = conn.Close()
+		}
+	}()
+
+	config := NewSshConfigFactoryImpl("test", keyPaths...).Config()
+	config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	conn, err := ssh.Dial("tcp", listener.Addr().String(), config)
+	assert.NoError(t, err, "second key not offered")
+	if conn != nil {
+		_ = conn.Close()
+	}
+}
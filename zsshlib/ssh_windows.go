@@ -20,20 +20,30 @@ import (
 	"github.com/natefinch/npipe"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
+	"net"
+	"os"
 	"sync"
+	"syscall"
 	"time"
 )
 
+// ttyDevice is the console input buffer, used for prompts when stdin is in use
+const ttyDevice = "CONIN$"
+
 var warnOnce = sync.Once{}
 var pipePresent = true
 
-func sshAuthMethodAgent() ssh.AuthMethod {
+func dialAgent() (net.Conn, error) {
+	return npipe.DialTimeout(`\\.\pipe\openssh-ssh-agent`, 1*time.Second)
+}
+
+func sshAgentSigners() func() ([]ssh.Signer, error) {
 	if !pipePresent {
 		return nil
 	}
 
-	if sshAgent, err := npipe.DialTimeout(`\\.\pipe\openssh-ssh-agent`, 1*time.Second); err == nil {
-		return ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers)
+	if sshAgent, err := dialAgent(); err == nil {
+		return agentSigners(agent.NewClient(sshAgent))
 	} else {
 		warnOnce.Do(func() {
 			pipePresent = false
@@ -42,3 +52,44 @@ func sshAuthMethodAgent() ssh.AuthMethod {
 	}
 	return nil
 }
+
+// the windows console has no SIGWINCH. It reports resizes as WINDOW_BUFFER_SIZE_EVENT input records, but only
+// ReadConsoleInput returns those, and it takes them off the same input buffer the session reads keystrokes from,
+// so the console size is polled instead. A poll is one GetConsoleScreenBufferInfo call, four a second while an
+// interactive shell is open, which costs no measurable CPU. The price is that a resize reaches the remote up to
+// windowSizePollInterval late. monitorWindowSize only sends a window-change when the size differs.
+const windowSizePollInterval = 250 * time.Millisecond
+
+// windowChangeEvents signals on the returned channel every windowSizePollInterval, until done is closed
+func windowChangeEvents(done <-chan struct{}) <-chan struct{} {
+	events := make(chan struct{}, 1)
+	go func() {
+		ticker := time.NewTicker(windowSizePollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				select {
+				case events <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return events
+}
+
+// controlMasterProcAttr keeps console control events sent to the invoking process away from the control master
+func controlMasterProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// fileAccessTime returns the last access time of a local file, or its modification time if unknown
+func fileAccessTime(info os.FileInfo) time.Time {
+	if data, ok := info.Sys().(*syscall.Win32FileAttributeData); ok {
+		return time.Unix(0, data.LastAccessTime.Nanoseconds())
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,472 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// SyncOptions controls Sync
+type SyncOptions struct {
+	TransferOptions
+	// Checksum compares file content instead of size and modification time to find changed files
+	Checksum bool
+	// Delete removes destination files that are not in the source
+	Delete bool
+	// Verify compares the SHA-256 of every transferred file with its source
+	Verify bool
+	// RemoteChecksum hashes remote files on the remote for Checksum. Without it, or when it fails, they are read
+	// over sftp and hashed here
+	RemoteChecksum ChecksumFunc
+	// Filter leaves files out of the sync, as do the patterns in the .zscpignore file of the source directory.
+	// Excluded destination files are never deleted.
+	Filter *PathFilter
+}
+
+// SyncResult counts what Sync did
+type SyncResult struct {
+	Transferred int
+	UpToDate    int
+	Deleted     int
+}
+
+// syncTree is the file system on one side of a sync
+type syncTree interface {
+	Stat(name string) (os.FileInfo, error)
+	Walk(root string, filter *PathFilter) (map[string]os.FileInfo, error)
+	Join(root string, rel string) string
+	Mkdir(name string, mode os.FileMode) error
+	Remove(name string, info os.FileInfo) error
+	Open(name string) (io.ReadCloser, error)
+	Checksum(name string) ([]byte, error)
+	SetAttributes(name string, info os.FileInfo) error
+}
+
+type localTree struct{}
+
+func (localTree) Stat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (localTree) Walk(root string, filter *PathFilter) (map[string]os.FileInfo, error) {
+	tree := map[string]os.FileInfo{}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if filter.Excluded(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		tree[rel] = info
+		return nil
+	})
+	return tree, err
+}
+
+func (localTree) Join(root string, rel string) string {
+	return filepath.Join(root, filepath.FromSlash(rel))
+}
+
+func (localTree) Mkdir(name string, mode os.FileMode) error {
+	return os.Mkdir(name, mode)
+}
+
+func (localTree) Remove(name string, _ os.FileInfo) error {
+	return os.Remove(name)
+}
+
+func (localTree) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (localTree) Checksum(name string) ([]byte, error) {
+	return LocalChecksum(name)
+}
+
+func (localTree) SetAttributes(name string, info os.FileInfo) error {
+	return SetLocalAttributes(name, info)
+}
+
+type remoteTree struct {
+	client   *sftp.Client
+	checksum ChecksumFunc
+}
+
+func (t remoteTree) Stat(name string) (os.FileInfo, error) {
+	return t.client.Lstat(name)
+}
+
+func (t remoteTree) Walk(root string, filter *PathFilter) (map[string]os.FileInfo, error) {
+	tree := map[string]os.FileInfo{}
+	walker := t.client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, err
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), root), "/")
+		if rel == "" {
+			continue
+		}
+		info := walker.Stat()
+		if filter.Excluded(rel, info.IsDir()) {
+			if info.IsDir() {
+				walker.SkipDir()
+			}
+			continue
+		}
+		tree[rel] = info
+	}
+	return tree, nil
+}
+
+func (t remoteTree) Join(root string, rel string) string {
+	return path.Join(root, rel)
+}
+
+func (t remoteTree) Mkdir(name string, mode os.FileMode) error {
+	if err := t.client.Mkdir(name); err != nil {
+		return err
+	}
+	return t.client.Chmod(name, mode)
+}
+
+func (t remoteTree) Remove(name string, info os.FileInfo) error {
+	if info.IsDir() {
+		return t.client.RemoveDirectory(name)
+	}
+	return t.client.Remove(name)
+}
+
+func (t remoteTree) Open(name string) (io.ReadCloser, error) {
+	f, err := t.client.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Checksum hashes name on the remote when the tree has a checksum function, and otherwise, or when the remote
+// can't hash it, reads the file over sftp
+func (t remoteTree) Checksum(name string) ([]byte, error) {
+	if t.checksum != nil {
+		sum, err := t.checksum(name)
+		if err == nil {
+			return sum, nil
+		}
+		log.Debugf("reading [%s] to hash it: %v", name, err)
+	}
+	f, err := t.client.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func (t remoteTree) SetAttributes(name string, info os.FileInfo) error {
+	return SetRemoteAttributes(t.client, name, info)
+}
+
+// Sync makes dst a copy of src, transferring only the files that differ. src is local and dst remote when
+// toRemote is set, the other way around otherwise. When src is a directory its content is synced into dst.
+// Like rsync -a, modes and modification times are always copied, they are how unchanged files are recognized.
+func Sync(client *sftp.Client, src string, dst string, toRemote bool, opts SyncOptions) (*SyncResult, error) {
+	var srcTree, dstTree syncTree = localTree{}, remoteTree{client: client, checksum: opts.RemoteChecksum}
+	if !toRemote {
+		srcTree, dstTree = dstTree, srcTree
+	}
+	transfer := func(srcPath string, dstPath string) error {
+		transferOpts := opts.TransferOptions
+		transferOpts.Preserve = true
+		var err error
+		if toRemote {
+			err = SendFile(client, srcPath, dstPath, transferOpts)
+		} else {
+			err = RetrieveRemoteFiles(client, dstPath, srcPath, transferOpts)
+		}
+		if err != nil || !opts.Verify {
+			return err
+		}
+		sum, err := VerifyTransfer(srcTree.Checksum, srcPath, dstTree.Checksum, dstPath)
+		if err != nil {
+			return err
+		}
+		log.Infof("verified %s: sha256 %x", dstPath, sum)
+		return nil
+	}
+	result := &SyncResult{}
+
+	srcInfo, err := srcTree.Stat(src)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read sync source [%s] (%w)", src, err)
+	}
+	dstInfo, dstErr := dstTree.Stat(dst)
+	if !srcInfo.IsDir() {
+		if dstErr == nil && dstInfo.IsDir() {
+			dst = dstTree.Join(dst, filepath.Base(src))
+			dstInfo, dstErr = dstTree.Stat(dst)
+		}
+		changed, err := syncChanged(srcTree, src, srcInfo, dstTree, dst, dstInfo, dstErr == nil, opts.Checksum)
+		if err != nil {
+			return nil, err
+		}
+		if !changed {
+			result.UpToDate++
+			return result, nil
+		}
+		if err := transfer(src, dst); err != nil {
+			return nil, err
+		}
+		result.Transferred++
+		return result, nil
+	}
+
+	if dstErr != nil {
+		if err := dstTree.Mkdir(dst, srcInfo.Mode().Perm()); err != nil {
+			return nil, fmt.Errorf("unable to create sync destination [%s] (%w)", dst, err)
+		}
+	} else if !dstInfo.IsDir() {
+		return nil, fmt.Errorf("cannot sync directory [%s] to file [%s]", src, dst)
+	}
+
+	filter, err := opts.Filter.WithIgnoreFile(srcTree.Open, srcTree.Join(src, IgnoreFileName))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s of [%s] (%w)", IgnoreFileName, src, err)
+	}
+	srcFiles, err := srcTree.Walk(src, filter)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read sync source [%s] (%w)", src, err)
+	}
+	dstFiles, err := dstTree.Walk(dst, filter)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read sync destination [%s] (%w)", dst, err)
+	}
+
+	// sorted, parent directories come before their content
+	rels := make([]string, 0, len(srcFiles))
+	for rel := range srcFiles {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+
+	var dirs []string
+	for _, rel := range rels {
+		srcInfo := srcFiles[rel]
+		srcPath, dstPath := srcTree.Join(src, rel), dstTree.Join(dst, rel)
+		dstInfo, exists := dstFiles[rel]
+
+		switch {
+		case srcInfo.IsDir():
+			if exists && !dstInfo.IsDir() {
+				return nil, fmt.Errorf("cannot sync directory [%s] to file [%s]", srcPath, dstPath)
+			}
+			if !exists {
+				if err := dstTree.Mkdir(dstPath, srcInfo.Mode().Perm()); err != nil {
+					return nil, fmt.Errorf("unable to create directory [%s] (%w)", dstPath, err)
+				}
+			}
+			dirs = append(dirs, rel)
+		case srcInfo.Mode().IsRegular():
+			if exists && dstInfo.IsDir() {
+				return nil, fmt.Errorf("cannot sync file [%s] to directory [%s]", srcPath, dstPath)
+			}
+			changed, err := syncChanged(srcTree, srcPath, srcInfo, dstTree, dstPath, dstInfo, exists, opts.Checksum)
+			if err != nil {
+				return nil, err
+			}
+			if !changed {
+				result.UpToDate++
+				continue
+			}
+			if err := transfer(srcPath, dstPath); err != nil {
+				return nil, err
+			}
+			result.Transferred++
+		default:
+			log.Debugf("skipping [%s], not a regular file or directory", srcPath)
+		}
+	}
+
+	if opts.Delete {
+		var extraneous []string
+		for rel := range dstFiles {
+			if _, ok := srcFiles[rel]; !ok {
+				extraneous = append(extraneous, rel)
+			}
+		}
+		// reverse sorted, directory content goes before the directory
+		sort.Sort(sort.Reverse(sort.StringSlice(extraneous)))
+		for _, rel := range extraneous {
+			dstPath := dstTree.Join(dst, rel)
+			if err := dstTree.Remove(dstPath, dstFiles[rel]); err != nil {
+				return nil, fmt.Errorf("unable to delete [%s] (%w)", dstPath, err)
+			}
+			log.Debugf("deleted [%s]", dstPath)
+			result.Deleted++
+		}
+	}
+
+	// the content of the directories is final, their times can be set now
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := dstTree.SetAttributes(dstTree.Join(dst, dirs[i]), srcFiles[dirs[i]]); err != nil {
+			log.Warnf("%v", err)
+		}
+	}
+	return result, nil
+}
+
+// syncChanged reports whether the destination file needs to be transferred. Modification times are compared to
+// the second, which is all sftp keeps.
+func syncChanged(srcTree syncTree, srcPath string, srcInfo os.FileInfo, dstTree syncTree, dstPath string, dstInfo os.FileInfo, exists bool, checksum bool) (bool, error) {
+	if !exists || srcInfo.Size() != dstInfo.Size() {
+		return true, nil
+	}
+	if !checksum {
+		return !srcInfo.ModTime().Truncate(time.Second).Equal(dstInfo.ModTime().Truncate(time.Second)), nil
+	}
+	srcSum, err := srcTree.Checksum(srcPath)
+	if err != nil {
+		return false, fmt.Errorf("unable to checksum [%s] (%w)", srcPath, err)
+	}
+	dstSum, err := dstTree.Checksum(dstPath)
+	if err != nil {
+		return false, fmt.Errorf("unable to checksum [%s] (%w)", dstPath, err)
+	}
+	return !bytes.Equal(srcSum, dstSum), nil
+}
+
+func NewSyncCmd(flags *ScpFlags) *cobra.Command {
+	opts := SyncOptions{Filter: &PathFilter{}}
+	cmd := &cobra.Command{
+		Use:   "sync <source> <destination>",
+		Short: "Copy only the files that changed, like rsync",
+		Long: "Makes the destination a copy of the source, transferring only files whose size or modification time " +
+			"differ, or whose content differs with --checksum. One of source and destination is remote, " +
+			"<remoteUsername>@<targetIdentity>:[Remote Path]. When the source is a directory its content is synced " +
+			"into the destination directory. Modes and modification times are always copied.\n\n" + FilterHelp,
+		Example: "  zscp sync --delete --exclude '*.bak' ./conf admin@router1:/etc/app",
+		Args:    cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			logrus.StandardLogger().Level = logrus.FatalLevel
+			if flags.Debug {
+				log.SetLevel(logrus.DebugLevel)
+			}
+
+			src, dst := args[0], args[1]
+			toRemote := IsRemotePath(dst)
+			if toRemote == IsRemotePath(src) {
+				log.Fatalf(`one of source and destination must be remote, use ":" for the remote path`)
+			}
+			remoteTarget, localPath := dst, src
+			if !toRemote {
+				remoteTarget, localPath = src, dst
+			}
+			localPath, err := filepath.Abs(localPath)
+			if err != nil {
+				log.Fatalf("cannot determine absolute local file path: %v", err)
+			}
+
+			targetIdentity := ParseTargetIdentity(remoteTarget)
+			cfg := FindConfigByKey(targetIdentity)
+			CombineScp(cmd, flags, cfg)
+
+			sshConn := ConnectClient(&flags.SshFlags, remoteTarget, targetIdentity)
+			defer func() { _ = sshConn.Close() }()
+			client, err := NewSftpClient(sshConn, flags.ChunkSize, flags.MaxRequests)
+			if err != nil {
+				log.Fatalf("error creating sftp client: %v", err)
+			}
+			defer func() { _ = client.Close() }()
+
+			remotePath := ParseFilePath(remoteTarget)
+			if remotePath == "~" || remotePath == "" {
+				remotePath = "."
+			} else if strings.HasPrefix(remotePath, "~/") {
+				remotePath = remotePath[2:]
+			}
+			if remotePath, err = client.RealPath(remotePath); err != nil {
+				log.Fatalf("cannot find remote file path: %s [%v]", remotePath, err)
+			}
+
+			stdoutFd := int(os.Stdout.Fd())
+			width, _, _ := terminal.GetSize(stdoutFd)
+			progress := NewProgressBar(os.Stdout, !flags.Quiet && terminal.IsTerminal(stdoutFd), width)
+			opts.Progress = progress.Update
+			hasher := NewRemoteHasher(sshConn, client)
+			defer func() { _ = hasher.Close() }()
+			opts.RemoteChecksum = hasher.Checksum
+			opts.SrcHasher, opts.DstHasher = hasher, hasher
+
+			src, dst = localPath, remotePath
+			if !toRemote {
+				src, dst = remotePath, localPath
+			}
+			result, err := Sync(client, src, dst, toRemote, opts)
+			// the files transferred before a failure are part of the summary
+			progress.PrintSummary()
+			if err != nil {
+				log.Fatalf("sync failed: %v", err)
+			}
+			if !flags.Quiet {
+				fmt.Printf("%d transferred, %d up to date, %d deleted\n", result.Transferred, result.UpToDate, result.Deleted)
+			}
+		},
+	}
+
+	flags.AddCommonFlags(cmd)
+	flags.OIDCFlags(cmd)
+	flags.ControlFlags(cmd)
+	flags.TransferFlags(cmd)
+	cmd.Flags().BoolVarP(&flags.Quiet, "quiet", "q", false, "do not show progress bars or the transfer summary")
+	cmd.Flags().BoolVar(&opts.Checksum, "checksum", false, "compare file content instead of size and modification time")
+	cmd.Flags().BoolVar(&opts.Delete, "delete", false, "delete destination files that are not in the source")
+	cmd.Flags().BoolVar(&opts.Verify, "verify", false, "compare the SHA-256 of every transferred file with its source, hashed on the remote with the check-file sftp extension or sha256sum. fails on mismatches")
+	cmd.Flags().StringArrayVar(&opts.Filter.Excludes, "exclude", nil, "skip files matching the pattern. can be given multiple times")
+	cmd.Flags().StringArrayVar(&opts.Filter.Includes, "include", nil, "do not skip files matching the pattern even if excluded. can be given multiple times")
+	return cmd
+}
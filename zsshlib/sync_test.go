@@ -0,0 +1,102 @@
+package zsshlib
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathFilter(t *testing.T) {
+	filter := &PathFilter{Excludes: []string{"*.bak", "build/", "/conf/local.yml"}, Includes: []string{"keep.bak"}}
+	assert.Equal(t, filter.Excluded("a/b/old.bak", false), true, "name pattern not matched")
+	assert.Equal(t, filter.Excluded("a/keep.bak", false), false, "include did not override exclude")
+	assert.Equal(t, filter.Excluded("a/build", true), true, "directory pattern not matched")
+	assert.Equal(t, filter.Excluded("a/build", false), false, "directory pattern matched a file")
+	assert.Equal(t, filter.Excluded("conf/local.yml", false), true, "path pattern not matched")
+	assert.Equal(t, filter.Excluded("x/conf/local.yml", false), false, "path pattern not anchored")
+	assert.Equal(t, (*PathFilter)(nil).Excluded("a", false), false, "nil filter excluded a file")
+}
+
+func TestSync(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	write := func(name string, content string) {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(name), 0755))
+		assert.NoError(t, os.WriteFile(name, []byte(content), 0644))
+	}
+	write(filepath.Join(src, "a.txt"), "a")
+	write(filepath.Join(src, "sub", "b.txt"), "b")
+	write(filepath.Join(src, "sub", "b.bak"), "backup")
+	client := newSftpPipe(t)
+	opts := SyncOptions{Filter: &PathFilter{Excludes: []string{"*.bak"}}}
+
+	for name, toRemote := range map[string]bool{"send": true, "retrieve": false} {
+		assert.NoError(t, os.RemoveAll(dst))
+		result, err := Sync(client, src, dst, toRemote, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, *result, SyncResult{Transferred: 2}, name+": first sync not correct")
+		_, err = os.Stat(filepath.Join(dst, "sub", "b.bak"))
+		assert.True(t, os.IsNotExist(err), name+": excluded file synced")
+
+		result, err = Sync(client, src, dst, toRemote, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, *result, SyncResult{UpToDate: 2}, name+": unchanged files transferred")
+	}
+
+	// same size, different time
+	write(filepath.Join(src, "a.txt"), "A")
+	assert.NoError(t, os.Chtimes(filepath.Join(src, "a.txt"), time.Now(), time.Now().Add(time.Hour)))
+	write(filepath.Join(dst, "extra", "c.txt"), "c")
+	write(filepath.Join(dst, "keep.bak"), "excluded")
+	opts.Delete = true
+	result, err := Sync(client, src, dst, true, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, *result, SyncResult{Transferred: 1, UpToDate: 1, Deleted: 2}, "changed sync not correct")
+	content, _ := os.ReadFile(filepath.Join(dst, "a.txt"))
+	assert.Equal(t, string(content), "A", "changed file not synced")
+	_, err = os.Stat(filepath.Join(dst, "extra"))
+	assert.True(t, os.IsNotExist(err), "extraneous directory not deleted")
+	_, err = os.Stat(filepath.Join(dst, "keep.bak"))
+	assert.NoError(t, err, "excluded destination file deleted")
+
+	// same size and time, different content, only found by checksum
+	info, _ := os.Stat(filepath.Join(dst, "a.txt"))
+	write(filepath.Join(dst, "a.txt"), "x")
+	assert.NoError(t, os.Chtimes(filepath.Join(dst, "a.txt"), info.ModTime(), info.ModTime()))
+	result, err = Sync(client, src, dst, true, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, result.Transferred, 0, "size and time comparison found the change")
+	opts.Checksum = true
+	// the pipe serves the local file system, the remote hash is a local one
+	var remoteHashes int
+	opts.RemoteChecksum = func(name string) ([]byte, error) {
+		remoteHashes++
+		return LocalChecksum(name)
+	}
+	result, err = Sync(client, src, dst, true, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, result.Transferred, 1, "checksum comparison missed the change")
+	assert.Equal(t, remoteHashes, 2, "remote files not hashed on the remote")
+
+	// a remote that can't hash, e.g. an sftp-only account, is read over sftp
+	write(filepath.Join(dst, "a.txt"), "y")
+	assert.NoError(t, os.Chtimes(filepath.Join(dst, "a.txt"), info.ModTime(), info.ModTime()))
+	opts.RemoteChecksum = func(string) ([]byte, error) { return nil, errors.New("sha256sum: command not found") }
+	result, err = Sync(client, src, dst, true, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, result.Transferred, 1, "checksum comparison without a remote hash missed the change")
+	content, _ = os.ReadFile(filepath.Join(dst, "a.txt"))
+	assert.Equal(t, string(content), "A", "changed file not synced")
+
+	// the patterns of the source's ignore file protect destination files from --delete too
+	write(filepath.Join(src, IgnoreFileName), "*.log\n")
+	write(filepath.Join(dst, "run.log"), "log")
+	_, err = Sync(client, src, dst, true, opts)
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dst, "run.log"))
+	assert.NoError(t, err, "ignored destination file deleted")
+}
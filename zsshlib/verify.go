@@ -0,0 +1,340 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrChecksumMismatch is returned by VerifyTransfer when the destination differs from the source
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ChecksumFunc returns the SHA-256 of the content of the file at name
+type ChecksumFunc func(name string) ([]byte, error)
+
+// sftp packet types and the version used to ask a server for a check-file hash
+const (
+	sshFxpInit          = 1
+	sshFxpVersion       = 2
+	sshFxpStatus        = 101
+	sshFxpExtended      = 200
+	sshFxpExtendedReply = 201
+	sftpVersion         = 3
+
+	checkFileExtension = "check-file"
+)
+
+// LocalChecksum is a ChecksumFunc for local files
+func LocalChecksum(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// RemoteHasher computes the SHA-256 of remote files on the remote, so their content isn't read over the network
+// again. Servers offering the check-file sftp extension hash the file themselves, on the others sha256sum is run.
+type RemoteHasher struct {
+	sshClient  *ssh.Client
+	sftpClient *sftp.Client
+
+	mu               sync.Mutex
+	checkFileSession *ssh.Session
+	checkFiles       *checkFileConn
+}
+
+// NewRemoteHasher returns a RemoteHasher for the remote of sshClient. sftpClient, a session on the same
+// connection, tells whether the server supports check-file.
+func NewRemoteHasher(sshClient *ssh.Client, sftpClient *sftp.Client) *RemoteHasher {
+	return &RemoteHasher{sshClient: sshClient, sftpClient: sftpClient}
+}
+
+// Checksum is a ChecksumFunc for remote files
+func (h *RemoteHasher) Checksum(remotePath string) ([]byte, error) {
+	return h.PrefixChecksum(remotePath, 0)
+}
+
+// PrefixChecksum returns the SHA-256 of the first length bytes of remotePath, of all of it when length is 0
+func (h *RemoteHasher) PrefixChecksum(remotePath string, length int64) ([]byte, error) {
+	if _, ok := h.sftpClient.HasExtension(checkFileExtension); ok {
+		sum, err := h.checkFile(remotePath, length)
+		if err == nil {
+			return sum, nil
+		}
+		log.Debugf("check-file of [%s] failed, trying sha256sum: %v", remotePath, err)
+	}
+	sum, err := h.sha256sum(remotePath, length)
+	if err != nil {
+		return nil, fmt.Errorf("unable to checksum remote file [%s] (%w)", remotePath, err)
+	}
+	return sum, nil
+}
+
+// checkFile asks the sftp server for the hash. pkg/sftp can't send extended requests, so a second sftp session
+// is opened for them on first use and kept for the following ones. After a failure it is closed, the stream may be
+// out of step with the requests, and the next check-file opens a new one.
+func (h *RemoteHasher) checkFile(remotePath string, length int64) ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.checkFiles == nil {
+		if err := h.openCheckFileSession(); err != nil {
+			return nil, err
+		}
+	}
+	sum, err := h.checkFiles.checkFile(remotePath, length)
+	if err != nil {
+		_ = h.checkFileSession.Close()
+		h.checkFileSession, h.checkFiles = nil, nil
+	}
+	return sum, err
+}
+
+func (h *RemoteHasher) openCheckFileSession() error {
+	session, err := h.sshClient.NewSession()
+	if err != nil {
+		return err
+	}
+	in, err := session.StdinPipe()
+	if err == nil {
+		var out io.Reader
+		if out, err = session.StdoutPipe(); err == nil {
+			if err = session.RequestSubsystem("sftp"); err == nil {
+				h.checkFiles, err = newCheckFileConn(struct {
+					io.Reader
+					io.Writer
+				}{out, in})
+			}
+		}
+	}
+	if err != nil {
+		_ = session.Close()
+		return err
+	}
+	h.checkFileSession = session
+	return nil
+}
+
+// Close closes the sftp session kept for check-file requests
+func (h *RemoteHasher) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.checkFileSession == nil {
+		return nil
+	}
+	err := h.checkFileSession.Close()
+	h.checkFileSession, h.checkFiles = nil, nil
+	return err
+}
+
+// sha256sum runs sha256sum on the remote, on the output of head -c for a prefix
+func (h *RemoteHasher) sha256sum(remotePath string, length int64) ([]byte, error) {
+	session, err := h.sshClient.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = session.Close() }()
+	command := "sha256sum -- " + shellQuote(remotePath)
+	if length > 0 {
+		command = fmt.Sprintf("head -c %d -- %s | sha256sum", length, shellQuote(remotePath))
+	}
+	out, err := session.Output(command)
+	if err != nil {
+		return nil, fmt.Errorf("sha256sum failed: %w", err)
+	}
+	return parseSha256sum(out)
+}
+
+// VerifyTransfer hashes the source and destination of a transfer at the same time and returns the checksum, or
+// an error wrapping ErrChecksumMismatch when they differ
+func VerifyTransfer(src ChecksumFunc, srcPath string, dst ChecksumFunc, dstPath string) ([]byte, error) {
+	type result struct {
+		sum []byte
+		err error
+	}
+	srcResult := make(chan result, 1)
+	go func() {
+		sum, err := src(srcPath)
+		srcResult <- result{sum, err}
+	}()
+	dstSum, dstErr := dst(dstPath)
+	s := <-srcResult
+	if s.err != nil {
+		return nil, s.err
+	}
+	if dstErr != nil {
+		return nil, dstErr
+	}
+	if !bytes.Equal(s.sum, dstSum) {
+		return nil, fmt.Errorf("%w: [%s] has sha256 %x, [%s] has %x", ErrChecksumMismatch, srcPath, s.sum, dstPath, dstSum)
+	}
+	log.Debugf("verified [%s]: sha256 %x", dstPath, dstSum)
+	return dstSum, nil
+}
+
+// checkFileConn is an sftp session used only for check-file requests
+type checkFileConn struct {
+	rw     io.ReadWriter
+	nextID uint32
+}
+
+// newCheckFileConn initializes the sftp session on rw
+func newCheckFileConn(rw io.ReadWriter) (*checkFileConn, error) {
+	if err := writeSftpPacket(rw, sshFxpInit, uint32(sftpVersion)); err != nil {
+		return nil, err
+	}
+	if typ, _, err := readSftpPacket(rw); err != nil {
+		return nil, err
+	} else if typ != sshFxpVersion {
+		return nil, fmt.Errorf("unexpected sftp packet %d, expected version", typ)
+	}
+	return &checkFileConn{rw: rw}, nil
+}
+
+// checkFile sends the check-file-name request of draft-ietf-secsh-filexfer-extensions for the SHA-256 of the first
+// length bytes of remotePath, all of it for 0, and returns the hash
+func (c *checkFileConn) checkFile(remotePath string, length int64) ([]byte, error) {
+	c.nextID++
+	requestID := c.nextID
+	// a length of 0 is the whole file, a block size of 0 a single hash of the range
+	if err := writeSftpPacket(c.rw, sshFxpExtended, requestID, sftpString("check-file-name"), sftpString(remotePath),
+		sftpString("sha256"), uint64(0), uint64(length), uint32(0)); err != nil {
+		return nil, err
+	}
+	typ, data, err := readSftpPacket(c.rw)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(data)
+	var id uint32
+	if err := binary.Read(r, binary.BigEndian, &id); err != nil {
+		return nil, err
+	}
+	if id != requestID {
+		return nil, fmt.Errorf("sftp reply %d does not answer check-file request %d", id, requestID)
+	}
+	switch typ {
+	case sshFxpStatus:
+		var code uint32
+		_ = binary.Read(r, binary.BigEndian, &code)
+		msg, _ := readSftpString(r)
+		return nil, fmt.Errorf("check-file failed with status %d: %s", code, msg)
+	case sshFxpExtendedReply:
+	default:
+		return nil, fmt.Errorf("unexpected sftp packet %d, expected extended reply", typ)
+	}
+	if _, err := readSftpString(r); err != nil { // "check-file"
+		return nil, err
+	}
+	algorithm, err := readSftpString(r)
+	if err != nil {
+		return nil, err
+	}
+	if algorithm != "sha256" {
+		return nil, fmt.Errorf("server hashed with %s instead of sha256", algorithm)
+	}
+	sum, _ := io.ReadAll(r)
+	if len(sum) != sha256.Size {
+		return nil, fmt.Errorf("invalid check-file hash of %d bytes", len(sum))
+	}
+	return sum, nil
+}
+
+// sftpString is a string field of an sftp packet
+type sftpString string
+
+// writeSftpPacket writes a packet of type typ with the fields, which are uint32, uint64 or sftpString
+func writeSftpPacket(w io.Writer, typ byte, fields ...any) error {
+	var payload bytes.Buffer
+	payload.WriteByte(typ)
+	for _, field := range fields {
+		if s, ok := field.(sftpString); ok {
+			_ = binary.Write(&payload, binary.BigEndian, uint32(len(s)))
+			payload.WriteString(string(s))
+		} else {
+			_ = binary.Write(&payload, binary.BigEndian, field)
+		}
+	}
+	packet := binary.BigEndian.AppendUint32(nil, uint32(payload.Len()))
+	_, err := w.Write(append(packet, payload.Bytes()...))
+	return err
+}
+
+// readSftpPacket reads a packet and returns its type and the data after it
+func readSftpPacket(r io.Reader) (byte, []byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return 0, nil, err
+	}
+	if length == 0 || length > 256*1024 {
+		return 0, nil, fmt.Errorf("invalid sftp packet length %d", length)
+	}
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return 0, nil, err
+	}
+	return packet[0], packet[1:], nil
+}
+
+func readSftpString(r *bytes.Reader) (string, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+	if int64(length) > int64(r.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+	s := make([]byte, length)
+	_, _ = io.ReadFull(r, s)
+	return string(s), nil
+}
+
+// parseSha256sum returns the hash in the output of sha256sum
+func parseSha256sum(out []byte) ([]byte, error) {
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return nil, errors.New("no output from sha256sum")
+	}
+	// names with special characters are escaped and the hash marked with a leading backslash
+	sum, err := hex.DecodeString(strings.TrimPrefix(fields[0], `\`))
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("unexpected sha256sum output [%s]", strings.TrimSpace(string(out)))
+	}
+	return sum, nil
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,120 @@
+package zsshlib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serveCheckFile answers the init and the check-file-name requests on rw the way a server with the extension does,
+// adding idSkew to the id of its replies
+func serveCheckFile(t *testing.T, rw io.ReadWriter, files map[string][]byte, idSkew uint32) {
+	typ, _, err := readSftpPacket(rw)
+	assert.NoError(t, err)
+	assert.Equal(t, typ, byte(sshFxpInit), "init not sent")
+	assert.NoError(t, writeSftpPacket(rw, sshFxpVersion, uint32(sftpVersion), sftpString(checkFileExtension), sftpString("sha256")))
+
+	for {
+		typ, data, err := readSftpPacket(rw)
+		if err != nil {
+			return
+		}
+		assert.Equal(t, typ, byte(sshFxpExtended), "extended request not sent")
+		r := bytes.NewReader(data)
+		var id uint32
+		_ = binary.Read(r, binary.BigEndian, &id)
+		request, _ := readSftpString(r)
+		assert.Equal(t, request, "check-file-name", "wrong extended request")
+		name, _ := readSftpString(r)
+		algorithms, _ := readSftpString(r)
+		assert.Equal(t, algorithms, "sha256", "wrong hash algorithms")
+
+		content, ok := files[name]
+		if !ok {
+			assert.NoError(t, writeSftpPacket(rw, sshFxpStatus, id+idSkew, uint32(2), sftpString("no such file"), sftpString("")))
+			continue
+		}
+		sum := sha256.Sum256(content)
+		assert.NoError(t, writeSftpPacket(rw, sshFxpExtendedReply, id+idSkew, sftpString(checkFileExtension), sftpString("sha256"), sum[:]))
+	}
+}
+
+// newCheckFilePipe returns a checkFileConn to serveCheckFile
+func newCheckFilePipe(t *testing.T, files map[string][]byte, idSkew uint32) *checkFileConn {
+	clientRead, serverWrite := io.Pipe()
+	serverRead, clientWrite := io.Pipe()
+	go serveCheckFile(t, struct {
+		io.Reader
+		io.Writer
+	}{serverRead, serverWrite}, files, idSkew)
+	t.Cleanup(func() { _ = clientWrite.Close() })
+
+	conn, err := newCheckFileConn(struct {
+		io.Reader
+		io.Writer
+	}{clientRead, clientWrite})
+	assert.NoError(t, err)
+	return conn
+}
+
+func TestCheckFile(t *testing.T) {
+	files := map[string][]byte{"/srv/release.tar.gz": []byte("release"), "/srv/notes.txt": []byte("notes")}
+	// one session answers all the requests
+	conn := newCheckFilePipe(t, files, 0)
+	for _, name := range []string{"/srv/release.tar.gz", "/srv/missing", "/srv/notes.txt"} {
+		sum, err := conn.checkFile(name, 0)
+		if content, ok := files[name]; ok {
+			want := sha256.Sum256(content)
+			assert.NoError(t, err)
+			assert.Equal(t, sum, want[:], "wrong check-file hash")
+		} else {
+			assert.ErrorContains(t, err, "no such file", "check-file status not returned")
+		}
+	}
+	assert.Equal(t, conn.nextID, uint32(3), "request ids not increasing")
+
+	_, err := newCheckFilePipe(t, files, 1).checkFile("/srv/release.tar.gz", 0)
+	assert.ErrorContains(t, err, "does not answer", "reply to another request accepted")
+}
+
+func TestParseSha256sum(t *testing.T) {
+	want := sha256.Sum256([]byte("release"))
+	for _, out := range []string{
+		"a4d451ec23463726f72c43d64c710968f6b602cd653b4de8adee1b556240a829  /srv/release.tar.gz\n",
+		`\a4d451ec23463726f72c43d64c710968f6b602cd653b4de8adee1b556240a829  /srv/new\nline` + "\n",
+	} {
+		sum, err := parseSha256sum([]byte(out))
+		assert.NoError(t, err)
+		assert.Equal(t, sum, want[:], "wrong hash parsed")
+	}
+	_, err := parseSha256sum([]byte("sha256sum: /srv/missing: No such file or directory\n"))
+	assert.Error(t, err, "error output parsed")
+
+	assert.Equal(t, shellQuote("/srv/it's here"), `'/srv/it'\''s here'`, "wrong quoting")
+}
+
+func TestVerifyTransfer(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	assert.NoError(t, os.WriteFile(src, []byte("release"), 0644))
+	assert.NoError(t, os.WriteFile(dst, []byte("release"), 0644))
+
+	sum, err := VerifyTransfer(LocalChecksum, src, LocalChecksum, dst)
+	assert.NoError(t, err)
+	want := sha256.Sum256([]byte("release"))
+	assert.Equal(t, sum, want[:], "wrong checksum returned")
+
+	assert.NoError(t, os.WriteFile(dst, []byte("relea5e"), 0644))
+	_, err = VerifyTransfer(LocalChecksum, src, LocalChecksum, dst)
+	assert.True(t, errors.Is(err, ErrChecksumMismatch), "mismatch not detected")
+
+	_, err = VerifyTransfer(LocalChecksum, src, LocalChecksum, filepath.Join(dir, "missing"))
+	assert.True(t, errors.Is(err, os.ErrNotExist), "missing destination not reported")
+}
@@ -0,0 +1,207 @@
+/*
+	Copyright NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package zsshlib
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/sftp"
+)
+
+// LinkPolicy is what a recursive copy does with symbolic links
+type LinkPolicy string
+
+const (
+	// LinksCopy copies what the link points to, as scp does
+	LinksCopy LinkPolicy = "copy"
+	// LinksPreserve recreates the link at the destination
+	LinksPreserve LinkPolicy = "preserve"
+	// LinksSkip leaves links out
+	LinksSkip LinkPolicy = "skip"
+)
+
+var LinkPolicies = []LinkPolicy{LinksCopy, LinksPreserve, LinksSkip}
+
+// ParseLinkPolicy returns the LinkPolicy named s, LinksCopy when s is empty
+func ParseLinkPolicy(s string) (LinkPolicy, error) {
+	if s == "" {
+		return LinksCopy, nil
+	}
+	for _, policy := range LinkPolicies {
+		if LinkPolicy(s) == policy {
+			return policy, nil
+		}
+	}
+	return "", fmt.Errorf("invalid link policy [%s], must be one of %v", s, LinkPolicies)
+}
+
+// TreeEntry is a file, directory or link found by WalkLocalTree or WalkRemoteTree
+type TreeEntry struct {
+	Path string
+	// Rel is Path relative to the root, slash separated. It is empty for the root.
+	Rel  string
+	Info os.FileInfo
+	// LinkTarget is where a preserved link points to. Info is then the link's own.
+	LinkTarget string
+}
+
+// treeReader is the file system WalkLocalTree and WalkRemoteTree read
+type treeReader struct {
+	stat     func(name string) (os.FileInfo, error)
+	readDir  func(name string) ([]os.FileInfo, error)
+	readLink func(name string) (string, error)
+	realPath func(name string) (string, error)
+	join     func(elem ...string) string
+}
+
+// WalkLocalTree calls fn for root and everything below it that filter does not exclude, parents before their
+// content. Links below root are handled as links says, root itself is always followed. Links that would copy a
+// directory into itself are skipped.
+func WalkLocalTree(root string, filter *PathFilter, links LinkPolicy, fn func(e TreeEntry) error) error {
+	return walkTree(treeReader{
+		stat: os.Stat,
+		readDir: func(name string) ([]os.FileInfo, error) {
+			entries, err := os.ReadDir(name)
+			if err != nil {
+				return nil, err
+			}
+			infos := make([]os.FileInfo, 0, len(entries))
+			for _, entry := range entries {
+				info, err := entry.Info()
+				if err != nil {
+					return nil, err
+				}
+				infos = append(infos, info)
+			}
+			return infos, nil
+		},
+		readLink: os.Readlink,
+		realPath: filepath.EvalSymlinks,
+		join:     filepath.Join,
+	}, root, filter, links, fn)
+}
+
+// WalkRemoteTree is WalkLocalTree for a remote tree
+func WalkRemoteTree(client *sftp.Client, root string, filter *PathFilter, links LinkPolicy, fn func(e TreeEntry) error) error {
+	return walkTree(treeReader{
+		stat:     client.Stat,
+		readDir:  client.ReadDir,
+		readLink: client.ReadLink,
+		realPath: client.RealPath,
+		join:     path.Join,
+	}, root, filter, links, fn)
+}
+
+func walkTree(r treeReader, root string, filter *PathFilter, links LinkPolicy, fn func(e TreeEntry) error) error {
+	info, err := r.stat(root)
+	if err != nil {
+		return err
+	}
+	return walkTreeEntry(r, TreeEntry{Path: root, Info: info}, filter, links, map[string]bool{}, fn)
+}
+
+// walkTreeEntry walks e. ancestors holds the real paths of the directories above e to catch link loops.
+func walkTreeEntry(r treeReader, e TreeEntry, filter *PathFilter, links LinkPolicy, ancestors map[string]bool, fn func(e TreeEntry) error) error {
+	if !e.Info.IsDir() {
+		return fn(e)
+	}
+	real, err := r.realPath(e.Path)
+	if err != nil {
+		return err
+	}
+	if ancestors[real] {
+		log.Warnf("skipping [%s], it links to a directory it is in", e.Path)
+		return nil
+	}
+	if err := fn(e); err != nil {
+		return err
+	}
+	ancestors[real] = true
+	defer delete(ancestors, real)
+
+	infos, err := r.readDir(e.Path)
+	if err != nil {
+		return err
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	for _, info := range infos {
+		child := TreeEntry{Path: r.join(e.Path, info.Name()), Rel: path.Join(e.Rel, info.Name()), Info: info}
+		if info.Mode()&os.ModeSymlink != 0 {
+			switch links {
+			case LinksSkip:
+				log.Debugf("skipping link [%s]", child.Path)
+				continue
+			case LinksPreserve:
+				if child.LinkTarget, err = r.readLink(child.Path); err != nil {
+					return err
+				}
+			default:
+				if child.Info, err = r.stat(child.Path); err != nil {
+					log.Warnf("skipping link [%s]: %v", child.Path, err)
+					continue
+				}
+			}
+		}
+		if filter.Excluded(child.Rel, child.Info.IsDir()) {
+			continue
+		}
+		if err := walkTreeEntry(r, child, filter, links, ancestors, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateRemoteLink makes remotePath a symbolic link to target, replacing a file already there
+func CreateRemoteLink(client *sftp.Client, target string, remotePath string) error {
+	_ = client.Remove(remotePath)
+	if err := client.Symlink(target, remotePath); err != nil {
+		return fmt.Errorf("unable to create remote link [%s] (%w)", remotePath, err)
+	}
+	return nil
+}
+
+// CreateLocalLink makes localPath a symbolic link to target, replacing a file already there
+func CreateLocalLink(target string, localPath string) error {
+	_ = os.Remove(localPath)
+	if err := os.Symlink(target, localPath); err != nil {
+		return fmt.Errorf("unable to create local link [%s] (%w)", localPath, err)
+	}
+	return nil
+}
+
+// DirectoryAttributes sets the modes and times of the directories a recursive copy creates. They are set once
+// the content of the directories is written, deepest first.
+type DirectoryAttributes []func() error
+
+// Add queues set, which sets the attributes of a directory, after those of its parent
+func (d *DirectoryAttributes) Add(set func() error) {
+	*d = append(*d, set)
+}
+
+// Apply runs the queued setters in reverse. Failures are only warned about.
+func (d *DirectoryAttributes) Apply() {
+	for i := len(*d) - 1; i >= 0; i-- {
+		if err := (*d)[i](); err != nil {
+			log.Warnf("%v", err)
+		}
+	}
+}
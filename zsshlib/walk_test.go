@@ -0,0 +1,73 @@
+package zsshlib
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWalkTree(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("creating links needs privileges on windows")
+	}
+	root := filepath.Join(t.TempDir(), "root")
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "conf", "old"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "conf", "app.yml"), []byte("app"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "conf", "app.bak"), []byte("bak"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "conf", "old", "a.yml"), []byte("a"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, IgnoreFileName), []byte("# backups\n*.bak\nold/\n!keep.bak\n"), 0644))
+	assert.NoError(t, os.Symlink("conf/app.yml", filepath.Join(root, "current.yml")))
+	assert.NoError(t, os.Symlink("conf", filepath.Join(root, "etc")))
+	assert.NoError(t, os.Symlink(".", filepath.Join(root, "conf", "loop")))
+	assert.NoError(t, os.Symlink("missing", filepath.Join(root, "dangling")))
+
+	filter, err := (&PathFilter{Excludes: []string{IgnoreFileName}}).WithIgnoreFile(openLocalFile, filepath.Join(root, IgnoreFileName))
+	assert.NoError(t, err)
+	assert.Equal(t, filter.Excluded("x/keep.bak", false), false, "ignore file include not read")
+
+	walk := func(walker func(fn func(e TreeEntry) error) error) []string {
+		var found []string
+		assert.NoError(t, walker(func(e TreeEntry) error {
+			entry := e.Rel
+			if e.Info.IsDir() {
+				entry += "/"
+			}
+			if e.LinkTarget != "" {
+				entry += " -> " + e.LinkTarget
+			}
+			found = append(found, entry)
+			return nil
+		}))
+		return found
+	}
+	local := func(links LinkPolicy) []string {
+		return walk(func(fn func(e TreeEntry) error) error { return WalkLocalTree(root, filter, links, fn) })
+	}
+
+	assert.Equal(t, strings.Join(local(LinksCopy), ","), "/,conf/,conf/app.yml,current.yml,etc/,etc/app.yml", "copied links not followed")
+	assert.Equal(t, strings.Join(local(LinksSkip), ","), "/,conf/,conf/app.yml", "links not skipped")
+	preserved := "/,conf/,conf/app.yml,conf/loop -> .,current.yml -> conf/app.yml,dangling -> missing,etc -> conf"
+	assert.Equal(t, strings.Join(local(LinksPreserve), ","), preserved, "links not preserved")
+
+	client := newSftpPipe(t)
+	remote := walk(func(fn func(e TreeEntry) error) error { return WalkRemoteTree(client, root, filter, LinksPreserve, fn) })
+	assert.Equal(t, strings.Join(remote, ","), preserved, "remote links not preserved")
+
+	dst := filepath.Join(t.TempDir(), "link")
+	assert.NoError(t, os.WriteFile(dst, nil, 0644))
+	assert.NoError(t, CreateRemoteLink(client, "conf/app.yml", dst))
+	target, _ := os.Readlink(dst)
+	assert.Equal(t, target, "conf/app.yml", "remote link not created")
+
+	_, err = ParseLinkPolicy("follow")
+	assert.Error(t, err, "invalid link policy accepted")
+}
+
+func openLocalFile(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}